@@ -0,0 +1,172 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/gc"
+	"github.com/vshn/signalilo/tracing"
+	"github.com/vshn/signalilo/webhook"
+)
+
+// adminError is returned by the admin endpoints if a request fails
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// checkAdminRequest authenticates a request to an admin endpoint and writes
+// the error response if the request must be rejected
+func checkAdminRequest(w http.ResponseWriter, r *http.Request, c config.Configuration) bool {
+	token := c.GetConfig().AdminBearerToken
+	if token == "" {
+		writeJSON(w, http.StatusNotFound, adminError{"admin endpoints are disabled, set --admin_bearer_token to enable them"})
+		return false
+	}
+	if err := webhook.CheckBearerToken(r, token); err != nil {
+		c.GetLogger().Errorf("Checking admin authentication: %v", err)
+		writeJSON(w, http.StatusUnauthorized, adminError{err.Error()})
+		return false
+	}
+	return true
+}
+
+// adminGC runs a garbage collection cycle and returns the report. With
+// query parameter dry_run=true, no services are deleted. Actual collections
+// must be requested with POST and are only run on the leader.
+func adminGC(w http.ResponseWriter, r *http.Request, c config.Configuration, isLeader func() bool) {
+	if !checkAdminRequest(w, r, c) {
+		return
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid dry_run: " + err.Error()})
+			return
+		}
+	}
+	if !dryRun && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{"garbage collection must be requested with POST, or use dry_run=true"})
+		return
+	}
+	if !dryRun && !isLeader() {
+		writeJSON(w, http.StatusConflict, adminError{"not the leader, garbage collection runs on the leader"})
+		return
+	}
+
+	c.GetLogger().Infof("Garbage collection requested through admin endpoint, dry run=%v", dryRun)
+	ts := time.Now()
+	report, err := gc.Run(tracing.Extract(r), ts, c, dryRun)
+	if !dryRun {
+		c.GetStats().GCCompleted(ts, report.Summary(), err)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, adminError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// servicesPath is the path of the admin API for managed services
+const servicesPath = "/api/v1/services"
+
+// serviceActionResult is returned by the services API after a service was
+// resolved or deleted
+type serviceActionResult struct {
+	Service string `json:"service"`
+	Action  string `json:"action"`
+}
+
+// adminServices serves the admin API for the services which are managed by
+// this Signalilo:
+//
+//	GET    /api/v1/services                lists the services
+//	GET    /api/v1/services/<name>         returns a single service
+//	POST   /api/v1/services/<name>/resolve submits an OK check result
+//	DELETE /api/v1/services/<name>         deletes the service
+func adminServices(w http.ResponseWriter, r *http.Request, c config.Configuration) {
+	if !checkAdminRequest(w, r, c) {
+		return
+	}
+	ctx := tracing.Extract(r)
+	l := c.GetLogger()
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, servicesPath), "/"), "/")
+	name := parts[0]
+
+	var allowed string
+	switch {
+	case len(parts) == 1 && name == "":
+		allowed = http.MethodGet
+		if r.Method == http.MethodGet {
+			services, err := gc.ListServices(ctx, c)
+			writeServicesResult(w, c, services, err)
+			return
+		}
+	case len(parts) == 1:
+		allowed = http.MethodGet + ", " + http.MethodDelete
+		switch r.Method {
+		case http.MethodGet:
+			svc, err := gc.GetService(ctx, c, name)
+			writeServicesResult(w, c, svc, err)
+			return
+		case http.MethodDelete:
+			l.Infof("Deleting service %v through admin API", name)
+			err := gc.DeleteService(ctx, c, name)
+			writeServicesResult(w, c, serviceActionResult{name, "delete"}, err)
+			return
+		}
+	case len(parts) == 2 && parts[1] == "resolve":
+		allowed = http.MethodPost
+		if r.Method == http.MethodPost {
+			ts := time.Now()
+			l.Infof("Resolving service %v through admin API", name)
+			output := fmt.Sprintf("OK: %v: resolved through the Signalilo admin API", ts.Format(time.RFC3339))
+			err := gc.ResolveService(ctx, ts, c, name, output)
+			writeServicesResult(w, c, serviceActionResult{name, "resolve"}, err)
+			return
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, adminError{"not found"})
+		return
+	}
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, adminError{fmt.Sprintf("method %v not allowed, use %v", r.Method, allowed)})
+}
+
+// writeServicesResult writes the response of the services API, which is v
+// unless the request failed with err
+func writeServicesResult(w http.ResponseWriter, c config.Configuration, v interface{}, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, v)
+	case errors.Is(err, gc.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, adminError{err.Error()})
+	default:
+		c.GetLogger().Errorf("Services admin API: %v", err)
+		writeJSON(w, http.StatusBadGateway, adminError{err.Error()})
+	}
+}
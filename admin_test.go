@@ -0,0 +1,134 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/gc"
+)
+
+func adminRequest(c config.Configuration, method, target, token string, leader bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	adminGC(w, r, c, func() bool { return leader })
+	return w
+}
+
+func TestAdminGC(t *testing.T) {
+	c := config.NewMockConfiguration(0)
+	c.GetConfig().UUID = "uuid"
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateService(icinga2.Service{
+		Name:     "old",
+		HostName: c.GetConfig().HostName,
+		Vars:     icinga2.Vars{"bridge_uuid": "uuid", "keep_for": float64(0)},
+	})
+	c.SetIcingaClient(icinga)
+
+	w := adminRequest(c, http.MethodPost, "/admin/gc", "admintoken", true)
+	assert.Equal(t, http.StatusNotFound, w.Code, "disabled without admin token")
+
+	c.GetConfig().AdminBearerToken = "admintoken"
+	w = adminRequest(c, http.MethodPost, "/admin/gc", c.GetConfig().AlertManagerConfig.BearerToken, true)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "webhook token isn't accepted")
+
+	w = adminRequest(c, http.MethodGet, "/admin/gc", "admintoken", true)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = adminRequest(c, http.MethodGet, "/admin/gc?dry_run=true", "admintoken", false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"decision":"delete"`)
+	assert.Len(t, icinga.Services, 1)
+
+	w = adminRequest(c, http.MethodPost, "/admin/gc", "admintoken", false)
+	assert.Equal(t, http.StatusConflict, w.Code, "standby doesn't collect")
+
+	w = adminRequest(c, http.MethodPost, "/admin/gc", "admintoken", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, icinga.Services, 0)
+}
+
+func servicesRequest(c config.Configuration, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer admintoken")
+	w := httptest.NewRecorder()
+	adminServices(w, r, c)
+	return w
+}
+
+func TestAdminServices(t *testing.T) {
+	c := config.NewMockConfiguration(0)
+	c.GetConfig().UUID = "uuid"
+	c.GetConfig().AdminBearerToken = "admintoken"
+	icinga := icinga2.NewMockClient()
+	for _, svc := range []icinga2.Service{
+		{Name: "firing", State: 2, Vars: icinga2.Vars{"bridge_uuid": "uuid", "keep_for": float64(time.Hour), "label_alertname": "Firing", "signalilo_last_update": float64(1600000000)}},
+		{Name: "other", Vars: icinga2.Vars{"bridge_uuid": "other", "keep_for": float64(time.Hour)}},
+	} {
+		svc.HostName = c.GetConfig().HostName
+		_ = icinga.CreateService(svc)
+	}
+	c.SetIcingaClient(icinga)
+
+	w := servicesRequest(c, http.MethodGet, "/api/v1/services")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var services []gc.ManagedService
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &services))
+	if assert.Len(t, services, 1, "only services of our UUID are listed") {
+		assert.Equal(t, "firing", services[0].Name)
+		assert.Equal(t, 2, services[0].State)
+		assert.Equal(t, "1h0m0s", services[0].KeepFor)
+		assert.Equal(t, map[string]string{"alertname": "Firing"}, services[0].Labels)
+		assert.Equal(t, int64(1600000000), services[0].LastUpdate.Unix())
+	}
+
+	w = servicesRequest(c, http.MethodGet, "/api/v1/services/firing")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"firing"`)
+	w = servicesRequest(c, http.MethodGet, "/api/v1/services/other")
+	assert.Equal(t, http.StatusNotFound, w.Code, "services of other instances aren't accessible")
+	w = servicesRequest(c, http.MethodPost, "/api/v1/services/firing")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, DELETE", w.Header().Get("Allow"))
+	w = servicesRequest(c, http.MethodGet, "/api/v1/services/firing/resolve")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	w = servicesRequest(c, http.MethodGet, "/api/v1/services/firing/unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = servicesRequest(c, http.MethodPost, "/api/v1/services/firing/resolve")
+	assert.Equal(t, http.StatusOK, w.Code)
+	actions := icinga.Actions[c.GetConfig().HostName+"!firing"]
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, 0, actions[0].ExitStatus)
+		assert.Contains(t, actions[0].PluginOutput, "resolved through the Signalilo admin API")
+	}
+
+	w = servicesRequest(c, http.MethodDelete, "/api/v1/services/other")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, icinga.Services, c.GetConfig().HostName+"!other")
+	w = servicesRequest(c, http.MethodDelete, "/api/v1/services/firing")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, icinga.Services, c.GetConfig().HostName+"!firing")
+
+	c.GetConfig().AdminBearerToken = ""
+	w = servicesRequest(c, http.MethodGet, "/api/v1/services")
+	assert.Equal(t, http.StatusNotFound, w.Code, "disabled without admin token")
+}
@@ -0,0 +1,135 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/bketelsen/logr"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/gc"
+	"github.com/vshn/signalilo/stats"
+)
+
+// AdoptCommand takes over or deletes the services of previous UUIDs of the
+// instance and prints the report
+type AdoptCommand struct {
+	logLevel     int
+	fromUUIDs    []string
+	delete       bool
+	dryRun       bool
+	config       config.SignaliloConfig
+	logger       logr.Logger
+	icingaClient icinga2.Client
+	stats        *stats.Stats
+	auditLog     *audit.Log
+}
+
+// GetConfig implements config.Configuration
+func (a *AdoptCommand) GetConfig() *config.SignaliloConfig {
+	return &a.config
+}
+
+// GetLogger implements config.Configuration
+func (a *AdoptCommand) GetLogger() logr.Logger {
+	return a.logger
+}
+
+// GetIcingaClient implements config.Configuration
+func (a *AdoptCommand) GetIcingaClient() icinga2.Client {
+	return a.icingaClient
+}
+
+// GetStats implements config.Configuration
+func (a *AdoptCommand) GetStats() *stats.Stats {
+	return a.stats
+}
+
+// GetAuditLog implements config.Configuration
+func (a *AdoptCommand) GetAuditLog() *audit.Log {
+	return a.auditLog
+}
+
+// SetAuditLog implements config.Configuration
+func (a *AdoptCommand) SetAuditLog(log *audit.Log) {
+	a.auditLog = log
+}
+
+// SetLogger implements config.Configuration
+func (a *AdoptCommand) SetLogger(logger logr.Logger) {
+	a.logger = logger
+}
+
+// SetIcingaClient implements config.Configuration
+func (a *AdoptCommand) SetIcingaClient(client icinga2.Client) {
+	a.icingaClient = client
+}
+
+func (a *AdoptCommand) initialize(ctx *kingpin.ParseContext) error {
+	if err := checkReportAuditLog("adopt", a.config); err != nil {
+		return err
+	}
+	a.logger = config.NewLogger(a.logLevel, a.config.LogFormat, a.config.LogOutput)
+	return config.ConfigInitialize(a)
+}
+
+// sourceUUIDs returns the UUIDs given with --from-uuid and --previous_uuid
+// without duplicates
+func (a *AdoptCommand) sourceUUIDs() []string {
+	var uuids []string
+	seen := map[string]bool{}
+	for _, uuid := range append(append([]string{}, a.fromUUIDs...), a.config.PreviousUUIDs...) {
+		if uuid != "" && !seen[uuid] {
+			seen[uuid] = true
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids
+}
+
+func (a *AdoptCommand) run(pc *kingpin.ParseContext) error {
+	uuids := a.sourceUUIDs()
+	if len(uuids) == 0 {
+		return fmt.Errorf("no UUIDs to adopt services from, use --from-uuid or --previous_uuid")
+	}
+	if a.GetIcingaClient() == nil {
+		return fmt.Errorf("unable to create Icinga API client, see log for details")
+	}
+	defer a.GetAuditLog().Close()
+	action := gc.AdoptTakeOver
+	if a.delete {
+		action = gc.AdoptDelete
+	}
+	report, err := gc.Adopt(context.Background(), time.Now(), a, uuids, action, a.dryRun)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func configureAdoptCommand(app *kingpin.Application) {
+	// The report is printed to stdout, so logs go to stderr
+	a := &AdoptCommand{logLevel: 1, stats: stats.New(), config: config.SignaliloConfig{LogOutput: config.LogOutputStderr}}
+	cmd := app.Command("adopt", "Take over or delete the services of previous UUIDs of this instance on the same host and print a JSON report").Action(a.run).PreAction(a.initialize)
+	configureIcingaFlags(cmd, &a.config)
+	configurePreviousUUIDFlag(cmd, &a.config)
+	cmd.Flag("from-uuid", "UUID whose services are adopted, in addition to --previous_uuid (can be repeated)").StringsVar(&a.fromUUIDs)
+	cmd.Flag("delete", "Delete the services instead of taking them over").BoolVar(&a.delete)
+	cmd.Flag("dry-run", "Only list the services which would be adopted, without modifying them").BoolVar(&a.dryRun)
+}
@@ -0,0 +1,22 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/signalilo/config"
+)
+
+func TestAdoptCommandRejectsAuditLogOnStdout(t *testing.T) {
+	a := &AdoptCommand{config: config.SignaliloConfig{AuditLogPath: "-"}}
+	assert.Error(t, a.initialize(nil))
+}
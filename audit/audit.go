@@ -0,0 +1,240 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package audit records every change which Signalilo makes in Icinga in an
+// append-only stream of JSON lines
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionServiceCreate  = "service_create"
+	ActionServiceUpdate  = "service_update"
+	ActionServiceDelete  = "service_delete"
+	ActionCheckResult    = "check_result"
+	ActionEndpointSwitch = "endpoint_switch"
+)
+
+// Triggers which cause changes in Icinga
+const (
+	TriggerWebhook   = "webhook"
+	TriggerGC        = "gc"
+	TriggerAdopt     = "adopt"
+	TriggerHeartbeat = "heartbeat"
+	TriggerWatchdog  = "watchdog"
+	TriggerFailover  = "failover"
+	TriggerAdmin     = "admin"
+)
+
+// stream identifies audit events when they're written to stdout together
+// with log messages
+const stream = "audit"
+
+// Change is the old and new value of a changed attribute
+type Change struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// Event is a single change made in Icinga
+type Event struct {
+	Stream       string            `json:"stream"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Action       string            `json:"action"`
+	Instance     string            `json:"instance,omitempty"`
+	Service      string            `json:"service,omitempty"`
+	RequestID    string            `json:"request_id,omitempty"`
+	Fingerprint  string            `json:"alert_fingerprint,omitempty"`
+	Trigger      string            `json:"trigger,omitempty"`
+	Changes      map[string]Change `json:"changes,omitempty"`
+	ExitStatus   *int              `json:"exit_status,omitempty"`
+	PluginOutput string            `json:"plugin_output,omitempty"`
+	From         string            `json:"from,omitempty"`
+	To           string            `json:"to,omitempty"`
+	Reason       string            `json:"reason,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// Log writes audit events as JSON lines. A nil *Log discards all events.
+// Log is safe for concurrent use.
+type Log struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	closer   io.Closer
+	instance string
+	now      func() time.Time
+}
+
+// New creates a Log which writes to out. Events are attributed to the
+// Signalilo instance.
+func New(out io.Writer, instance string) *Log {
+	return &Log{out: out, instance: instance, now: time.Now}
+}
+
+// Open opens the audit log at path for appending, creating it if
+// necessary. The path - writes to stdout. No audit log is written if path
+// is empty.
+func Open(path, instance string) (*Log, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return New(os.Stdout, instance), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	l := New(f, instance)
+	l.closer = f
+	return l, nil
+}
+
+// Close closes the underlying file, if any
+func (l *Log) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// Record writes event to the audit log. The request ID and alert
+// fingerprint are taken from ctx, if they're not set on the event.
+func (l *Log) Record(ctx context.Context, event Event) error {
+	if l == nil {
+		return nil
+	}
+	event.Stream = stream
+	if event.Timestamp.IsZero() {
+		event.Timestamp = l.now()
+	}
+	if event.Instance == "" {
+		event.Instance = l.instance
+	}
+	if event.RequestID == "" {
+		event.RequestID = RequestID(ctx)
+	}
+	if event.Fingerprint == "" {
+		event.Fingerprint = Fingerprint(ctx)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.out.Write(line)
+	return err
+}
+
+// ErrorMessage returns the message of err, or an empty string if err is nil
+func ErrorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	fingerprintKey
+)
+
+// WithRequestID returns a context which attributes changes to the request
+// with the given ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// WithFingerprint returns a context which attributes changes to the alert
+// with the given fingerprint
+func WithFingerprint(ctx context.Context, fingerprint string) context.Context {
+	return context.WithValue(ctx, fingerprintKey, fingerprint)
+}
+
+// RequestID returns the request ID carried by ctx
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Fingerprint returns the alert fingerprint carried by ctx
+func Fingerprint(ctx context.Context) string {
+	fp, _ := ctx.Value(fingerprintKey).(string)
+	return fp
+}
+
+// Diff returns the attributes which differ between the services old and
+// new. Variables are compared individually as vars.<name>. Templates
+// aren't compared, as they can't be changed on existing services.
+func Diff(old, new icinga2.Service) map[string]Change {
+	changes := map[string]Change{}
+	compare := func(name string, o, n interface{}) {
+		if !reflect.DeepEqual(o, n) {
+			changes[name] = Change{Old: o, New: n}
+		}
+	}
+	compare("display_name", old.DisplayName, new.DisplayName)
+	compare("check_command", old.CheckCommand, new.CheckCommand)
+	compare("enable_active_checks", old.EnableActiveChecks, new.EnableActiveChecks)
+	compare("notes", old.Notes, new.Notes)
+	compare("notes_url", old.NotesURL, new.NotesURL)
+	compare("action_url", old.ActionURL, new.ActionURL)
+	compare("check_interval", old.CheckInterval, new.CheckInterval)
+	compare("retry_interval", old.RetryInterval, new.RetryInterval)
+	compare("max_check_attempts", old.MaxCheckAttempts, new.MaxCheckAttempts)
+
+	names := map[string]bool{}
+	for k := range old.Vars {
+		names[k] = true
+	}
+	for k := range new.Vars {
+		names[k] = true
+	}
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		compare("vars."+k, normalize(old.Vars[k]), normalize(new.Vars[k]))
+	}
+	return changes
+}
+
+// normalize converts v to the type it has after a round trip through the
+// Icinga API, which returns all numbers as float64
+func normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case time.Duration:
+		return float64(val)
+	}
+	return v
+}
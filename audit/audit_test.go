@@ -0,0 +1,109 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "uuid")
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.now = func() time.Time { return ts }
+
+	ctx := WithFingerprint(WithRequestID(context.Background(), "req"), "fp")
+	exitStatus := 2
+	assert.NoError(t, l.Record(ctx, Event{
+		Action:       ActionCheckResult,
+		Trigger:      TriggerWebhook,
+		Service:      "host!svc",
+		ExitStatus:   &exitStatus,
+		PluginOutput: "CRITICAL",
+		Error:        ErrorMessage(fmt.Errorf("503 Service Unavailable")),
+	}))
+	assert.NoError(t, l.Record(context.Background(), Event{Action: ActionServiceDelete, Trigger: TriggerGC}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var event Event
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, "audit", event.Stream)
+	assert.True(t, ts.Equal(event.Timestamp))
+	assert.Equal(t, "uuid", event.Instance)
+	assert.Equal(t, "req", event.RequestID)
+	assert.Equal(t, "fp", event.Fingerprint)
+	assert.Equal(t, "503 Service Unavailable", event.Error)
+	assert.Equal(t, 2, *event.ExitStatus)
+	assert.NotContains(t, lines[1], "request_id", "empty attributes are omitted")
+	assert.NotContains(t, lines[1], "exit_status")
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	assert.NoError(t, l.Record(context.Background(), Event{Action: ActionServiceCreate}))
+	assert.NoError(t, l.Close())
+
+	l, err := Open("", "uuid")
+	assert.NoError(t, err)
+	assert.Nil(t, l, "no audit log is written without a path")
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path, "uuid")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, l.Record(context.Background(), Event{Action: ActionServiceCreate}))
+		assert.NoError(t, l.Close())
+	}
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), "\n"))
+
+	_, err = Open(filepath.Join(path, "missing", "audit.log"), "uuid")
+	assert.Error(t, err)
+}
+
+func TestDiff(t *testing.T) {
+	old := icinga2.Service{
+		DisplayName:   "svc",
+		CheckInterval: 43200,
+		Vars:          icinga2.Vars{"keep_for": float64(time.Hour), "label_a": "a", "removed": "x"},
+		Templates:     []string{"generic-service"},
+	}
+	new := icinga2.Service{
+		DisplayName:   "svc",
+		CheckInterval: 60,
+		Vars:          icinga2.Vars{"keep_for": time.Hour, "label_a": "b", "added": 1},
+	}
+	assert.Equal(t, map[string]Change{
+		"check_interval": {Old: float64(43200), New: float64(60)},
+		"vars.label_a":   {Old: "a", New: "b"},
+		"vars.removed":   {Old: "x", New: nil},
+		"vars.added":     {Old: nil, New: float64(1)},
+	}, Diff(old, new))
+	assert.Empty(t, Diff(old, old))
+}
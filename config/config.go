@@ -10,30 +10,37 @@
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bketelsen/logr"
-	"github.com/corvus-ch/logr/buffered"
-	log "github.com/corvus-ch/logr/logrus"
-	"github.com/sirupsen/logrus"
 	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/logging"
+	"github.com/vshn/signalilo/stats"
 )
 
 type icingaConfig struct {
-	URL               []string
-	User              string
-	Password          string
-	InsecureTLS       bool
-	X509VerifyCN      bool
-	DisableKeepAlives bool
-	Templates         []string
-	Debug             bool
+	URL                 []string
+	User                string
+	Password            string
+	InsecureTLS         bool
+	X509VerifyCN        bool
+	DisableKeepAlives   bool
+	Templates           []string
+	Debug               bool
+	HealthCheckInterval time.Duration
+	FailbackDelay       time.Duration
 }
 
 type Configuration interface {
@@ -44,6 +51,11 @@ type Configuration interface {
 
 	GetIcingaClient() icinga2.Client
 	SetIcingaClient(icinga icinga2.Client)
+
+	GetStats() *stats.Stats
+
+	GetAuditLog() *audit.Log
+	SetAuditLog(log *audit.Log)
 }
 
 type alertManagerConfig struct {
@@ -54,45 +66,212 @@ type alertManagerConfig struct {
 	PluginOutputAnnotations   []string
 	PluginOutputByStates      bool
 	PluginOutputStateSuffixes []string
+	PerfDataAnnotations       []string
+	PerfDataLabels            []string
+	LongOutputAnnotations     []string
+	LongOutputLabels          bool
+	MaxBodySize               int64
+	MaxAlerts                 int
+	APIURL                    string
+	APIBearerToken            string
+}
+
+type leaderElectionConfig struct {
+	Mode          string
+	LeaseName     string
+	Namespace     string
+	LockFile      string
+	Identity      string
+	LeaseDuration time.Duration
+}
+
+type tracingConfig struct {
+	OTLPEndpoint string
+	OTLPInsecure bool
+	SampleRatio  float64
+}
+
+// KeepForPolicy sets keep_for for all alerts whose label Label has the
+// value Value
+type KeepForPolicy struct {
+	Label   string
+	Value   string
+	KeepFor time.Duration
+}
+
+// ParseKeepForPolicy parses a keep_for policy in the format
+// label=value:duration
+func ParseKeepForPolicy(policy string) (KeepForPolicy, error) {
+	sep := strings.LastIndex(policy, ":")
+	if sep < 0 {
+		return KeepForPolicy{}, fmt.Errorf("keep_for policy %q: expected format label=value:duration", policy)
+	}
+	keepFor, err := time.ParseDuration(policy[sep+1:])
+	if err != nil {
+		return KeepForPolicy{}, fmt.Errorf("keep_for policy %q: %w", policy, err)
+	}
+	kv := strings.SplitN(policy[:sep], "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return KeepForPolicy{}, fmt.Errorf("keep_for policy %q: expected format label=value:duration", policy)
+	}
+	return KeepForPolicy{Label: kv[0], Value: kv[1], KeepFor: keepFor}, nil
 }
 
 type SignaliloConfig struct {
-	UUID                     string
-	HostName                 string
-	IcingaConfig             icingaConfig
-	GcInterval               time.Duration
-	AlertManagerConfig       alertManagerConfig
-	HeartbeatInterval        time.Duration
-	LogLevel                 int
-	DisplayNameAsServiceName bool
-	KeepFor                  time.Duration
-	CAData                   string
-	StaticServiceVars        map[string]string
-	CustomSeverityLevels     map[string]string
-	MergedSeverityLevels     map[string]int
-	ActiveChecks             bool
-	ChecksInterval           time.Duration
-	CheckCommand             string
-	MaxCheckAttempts         int
-	Reconnect                time.Duration
+	UUID                        string
+	HostName                    string
+	IcingaConfig                icingaConfig
+	GcInterval                  time.Duration
+	AlertManagerConfig          alertManagerConfig
+	HeartbeatInterval           time.Duration
+	HeartbeatErrorRateThreshold float64
+	HeartbeatBacklogThreshold   int
+	LogLevel                    int
+	LogFormat                   string
+	LogOutput                   string
+	DisplayNameAsServiceName    bool
+	KeepFor                     time.Duration
+	KeepForPolicyRules          []string
+	KeepForPolicies             []KeepForPolicy
+	MaxAge                      time.Duration
+	GCQuarantine                bool
+	GCConcurrency               int
+	PreviousUUIDs               []string
+	CAData                      string
+	StaticServiceVars           map[string]string
+	CustomSeverityLevels        map[string]string
+	MergedSeverityLevels        map[string]int
+	ActiveChecks                bool
+	ChecksInterval              time.Duration
+	CheckCommand                string
+	MaxCheckAttempts            int
+	Reconnect                   time.Duration
+	DedupCheckResults           bool
+	DedupRefreshInterval        time.Duration
+	CheckSource                 string
+	WatchdogWindow              time.Duration
+	WatchdogLabels              map[string]string
+	WatchdogServiceName         string
+	ShutdownTimeout             time.Duration
+	HeartbeatOnShutdown         bool
+	LeaderElection              leaderElectionConfig
+	AdminBearerToken            string
+	StatusPublic                bool
+	Tracing                     tracingConfig
+	AuditLogPath                string
+	IngestConfigPath            string
+}
+
+// redacted replaces secrets in configuration dumps
+const redacted = logging.Redacted
+
+// Redacted returns a copy of the configuration with all secrets replaced,
+// which is safe to log or display
+func (c SignaliloConfig) Redacted() SignaliloConfig {
+	if c.IcingaConfig.Password != "" {
+		c.IcingaConfig.Password = redacted
+	}
+	if c.AlertManagerConfig.BearerToken != "" {
+		c.AlertManagerConfig.BearerToken = redacted
+	}
+	if c.AdminBearerToken != "" {
+		c.AdminBearerToken = redacted
+	}
+	if c.AlertManagerConfig.APIBearerToken != "" {
+		c.AlertManagerConfig.APIBearerToken = redacted
+	}
+	c.AlertManagerConfig.APIURL = RedactURL(c.AlertManagerConfig.APIURL)
+	// API URLs may carry credentials as user info
+	urls := make([]string, 0, len(c.IcingaConfig.URL))
+	for _, u := range c.IcingaConfig.URL {
+		urls = append(urls, RedactURL(u))
+	}
+	c.IcingaConfig.URL = urls
+	return c
+}
+
+// Secrets returns the secrets in the configuration, which must not appear
+// in logs
+func (c SignaliloConfig) Secrets() []string {
+	secrets := []string{c.IcingaConfig.Password, c.AlertManagerConfig.BearerToken, c.AdminBearerToken, c.AlertManagerConfig.APIBearerToken}
+	urls := append([]string{c.AlertManagerConfig.APIURL}, c.IcingaConfig.URL...)
+	for _, u := range urls {
+		if parsed, err := url.Parse(u); err == nil && parsed.User != nil {
+			if password, ok := parsed.User.Password(); ok {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+	return secrets
+}
+
+// RedactURL replaces the password in the user info of rawURL, if there is
+// one
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
 }
 
-func ConfigInitialize(configuration Configuration) {
+// ConfigInitialize sets up the logger, audit log and Icinga client of
+// configuration and finalizes its configuration. It fails if the audit log
+// is configured but can't be opened, since changes made in Icinga must not
+// go unrecorded.
+func ConfigInitialize(configuration Configuration) error {
 	l := configuration.GetLogger()
 	config := configuration.GetConfig()
 
 	// do first init of Logger and IcingaClient
 	l.Infof("Configuring logger with LogLevel=%v", config.LogLevel)
-	configuration.SetLogger(NewLogger(config.LogLevel))
+	configuration.SetLogger(NewLogger(config.LogLevel, config.LogFormat, config.LogOutput, config.Secrets()...))
 	// Refresh local reference to logger after setup
 	l = configuration.GetLogger()
 
-	icinga, err := newIcingaClient(config, l)
+	auditLog, err := audit.Open(config.AuditLogPath, config.UUID)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	configuration.SetAuditLog(auditLog)
+
+	icinga, err := newIcingaClient(config, l, configuration.GetAuditLog())
 	if err != nil {
 		l.Errorf("Unable to create new icinga client: %s", err)
 	} else {
 		configuration.SetIcingaClient(icinga)
 	}
+	// Active checks mark services as stale if they don't receive a check
+	// result within the checks interval, so deduplicated check results
+	// must be resubmitted before that
+	if config.DedupCheckResults && config.ActiveChecks &&
+		(config.DedupRefreshInterval <= 0 || config.DedupRefreshInterval >= config.ChecksInterval) {
+		return fmt.Errorf("--icinga_dedup_refresh_interval must be set to less than --icinga_service_checks_interval (%v) "+
+			"when deduplicating check results of active checks", config.ChecksInterval)
+	}
+
+	// Leases store their duration in whole seconds
+	if le := config.LeaderElection; le.Mode != "" && le.Mode != "none" && le.LeaseDuration < time.Second {
+		return fmt.Errorf("--leader_election_lease_duration must be at least 1s, got %v", le.LeaseDuration)
+	}
+
+	// Identify check results submitted by this instance by its UUID,
+	// unless a check source is configured explicitly
+	if config.CheckSource == "" {
+		config.CheckSource = config.UUID
+	}
+
+	// Compete for the leader lease under the pod name when running in
+	// Kubernetes, unless an identity is configured explicitly
+	if config.LeaderElection.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			l.Errorf("Unable to determine hostname for leader election identity: %s", err)
+			hostname = config.UUID
+		}
+		config.LeaderElection.Identity = hostname
+	}
+
 	// finalize TLS config
 	if config.AlertManagerConfig.TLSCertPath != "" && config.AlertManagerConfig.TLSKeyPath != "" {
 		config.AlertManagerConfig.UseTLS = true
@@ -115,9 +294,20 @@ func ConfigInitialize(configuration Configuration) {
 	}
 	config.MergedSeverityLevels = allLevels
 
+	// Parse the keep_for policies, in the order in which they're given
+	config.KeepForPolicies = nil
+	for _, rule := range config.KeepForPolicyRules {
+		policy, err := ParseKeepForPolicy(rule)
+		if err != nil {
+			l.Errorf("Ignoring invalid keep_for policy: %s", err)
+			continue
+		}
+		config.KeepForPolicies = append(config.KeepForPolicies, policy)
+	}
+
 	// Set the suffixes used for the PluginOutputByStates
 	config.AlertManagerConfig.PluginOutputStateSuffixes = []string{"ok", "warning", "critical", "unknown"}
-
+	return nil
 }
 
 func makeCertPool(c *SignaliloConfig, l logr.Logger) (*x509.CertPool, error) {
@@ -128,7 +318,7 @@ func makeCertPool(c *SignaliloConfig, l logr.Logger) (*x509.CertPool, error) {
 	return rootCAs, nil
 }
 
-func newIcingaClient(c *SignaliloConfig, l logr.Logger) (icinga2.Client, error) {
+func newIcingaClient(c *SignaliloConfig, l logr.Logger, auditLog *audit.Log) (icinga2.Client, error) {
 	rootCAs, err := x509.SystemCertPool()
 	if err != nil && c.CAData == "" {
 		return nil, fmt.Errorf("could not load system rootCA and no CA provided: %w", err)
@@ -175,52 +365,125 @@ func newIcingaClient(c *SignaliloConfig, l logr.Logger) (icinga2.Client, error)
 		}
 	}
 
-	var client *icinga2.WebClient
-
-	for _, url := range c.IcingaConfig.URL {
-		client, err = icinga2.New(icinga2.WebClient{
+	// Each API URL gets its own client, so the endpoint manager can fail
+	// over without modifying a client which is in use. The TLS config is
+	// cloned, as each client's transport modifies it when enabling HTTP/2.
+	factory := func(url string) (icinga2.Client, error) {
+		return icinga2.New(icinga2.WebClient{
 			URL:               url,
 			Username:          c.IcingaConfig.User,
 			Password:          c.IcingaConfig.Password,
 			Debug:             c.IcingaConfig.Debug,
 			DisableKeepAlives: c.IcingaConfig.DisableKeepAlives,
-			TLSConfig:         tlsConfig})
-		if err != nil {
-			return nil, err
-		}
-		if err = client.TestIcingaApi(); err != nil {
-			// clear client if the API url wasn't reachable
-			client = nil
-			continue
-		} else {
-			break
-		}
+			TLSConfig:         tlsConfig.Clone()})
+	}
+
+	// --icinga_reconnect predates the endpoint manager. It used to delay
+	// switching away from the first URL, which the health checks now do
+	// immediately, and is only used as failback delay.
+	failbackDelay := c.IcingaConfig.FailbackDelay
+	if c.Reconnect > 0 {
+		l.Infof("Deprecated: --icinga_reconnect no longer delays switching away from an unreachable Icinga API URL, "+
+			"it's only used as failback delay if it's longer than --icinga_failback_delay (%v). Use --icinga_failback_delay instead.", c.IcingaConfig.FailbackDelay)
+	}
+	if c.Reconnect > failbackDelay {
+		failbackDelay = c.Reconnect
+	}
+
+	manager, err := endpoint.New(c.IcingaConfig.URL, factory, endpoint.Options{
+		HealthCheckInterval: c.IcingaConfig.HealthCheckInterval,
+		FailbackDelay:       failbackDelay,
+		OnSwitch: func(from, to, reason string) {
+			err := auditLog.Record(context.Background(), audit.Event{
+				Action:  audit.ActionEndpointSwitch,
+				Trigger: audit.TriggerFailover,
+				From:    RedactURL(from),
+				To:      RedactURL(to),
+				Reason:  reason,
+			})
+			if err != nil {
+				l.Errorf("Unable to write audit log: %v", err)
+			}
+		},
+	}, l)
+	if err != nil {
+		return nil, err
+	}
+	// Start in degraded mode if no endpoint is reachable. The endpoint
+	// manager's health checks keep retrying all endpoints in the
+	// background.
+	if err := manager.Probe(); err != nil {
+		l.Errorf("Starting without a reachable Icinga API, retrying in the background: %v", err)
+	}
+	return manager, nil
+}
+
+// Log outputs. Any other log output is the path of a file which logs are
+// appended to.
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+)
+
+var (
+	logFilesMutex sync.Mutex
+	// logFiles holds the log files opened by logWriter, so each file is
+	// only opened once when the logger is recreated
+	logFiles = map[string]*os.File{}
+)
+
+// logWriter returns the writer for the log output. Logs are written to
+// stdout by default.
+func logWriter(output string) (io.Writer, error) {
+	switch output {
+	case "", LogOutputStdout:
+		return os.Stdout, nil
+	case LogOutputStderr:
+		return os.Stderr, nil
 	}
-	if client == nil {
-		return nil, fmt.Errorf("no valid Icinga API URL found")
+	logFilesMutex.Lock()
+	defer logFilesMutex.Unlock()
+	if f, ok := logFiles[output]; ok {
+		return f, nil
 	}
-	return client, nil
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+	logFiles[output] = f
+	return f, nil
 }
 
-func NewLogger(verbosity int) logr.Logger {
-	jf := new(logrus.JSONFormatter)
-	ll := &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: jf,
-		Hooks:     make(logrus.LevelHooks),
-		Level:     logrus.DebugLevel,
+// NewLogger creates a logger which writes to output in the given format,
+// and redacts the given secrets. Unknown formats fall back to JSON, and
+// outputs which can't be opened fall back to stderr.
+func NewLogger(verbosity int, format, output string, secrets ...string) logr.Logger {
+	w, outputErr := logWriter(output)
+	if outputErr != nil {
+		w = os.Stderr
+	}
+	l, err := logging.New(verbosity, format, w, secrets...)
+	if err != nil {
+		l, _ = logging.New(verbosity, logging.FormatJSON, w, secrets...)
+		l.Errorf("Falling back to JSON logs: %v", err)
+	}
+	if outputErr != nil {
+		l.Errorf("Falling back to logging to stderr: %v", outputErr)
 	}
-	return log.New(verbosity, ll)
+	return l
 }
 
+// MockLogger creates a logger which discards all messages
 func MockLogger(verbosity int) logr.Logger {
-	return buffered.New(verbosity)
+	return logging.NewDiscard(verbosity)
 }
 
 type MockConfiguration struct {
 	config       SignaliloConfig
 	logger       logr.Logger
 	icingaClient icinga2.Client
+	stats        *stats.Stats
+	auditLog     *audit.Log
 }
 
 func (c *MockConfiguration) GetConfig() *SignaliloConfig {
@@ -232,6 +495,15 @@ func (c *MockConfiguration) GetLogger() logr.Logger {
 func (c *MockConfiguration) GetIcingaClient() icinga2.Client {
 	return c.icingaClient
 }
+func (c *MockConfiguration) GetStats() *stats.Stats {
+	return c.stats
+}
+func (c *MockConfiguration) GetAuditLog() *audit.Log {
+	return c.auditLog
+}
+func (c *MockConfiguration) SetAuditLog(log *audit.Log) {
+	c.auditLog = log
+}
 func (c *MockConfiguration) SetConfig(config SignaliloConfig) {
 	c.config = config
 }
@@ -261,22 +533,25 @@ func NewMockConfiguration(verbosity int) Configuration {
 		AlertManagerConfig: alertManagerConfig{
 			BearerToken: "aaaaaa",
 		},
-		HeartbeatInterval:        1 * time.Minute,
-		LogLevel:                 2,
-		DisplayNameAsServiceName: false,
-		KeepFor:                  5 * time.Minute,
-		CAData:                   "",
-		ActiveChecks:             false,
-		ChecksInterval:           12 * time.Hour,
-		CheckCommand:             "dummy",
-		MaxCheckAttempts:         1,
+		HeartbeatInterval:           1 * time.Minute,
+		HeartbeatErrorRateThreshold: 0.1,
+		HeartbeatBacklogThreshold:   10,
+		LogLevel:                    2,
+		DisplayNameAsServiceName:    false,
+		KeepFor:                     5 * time.Minute,
+		CAData:                      "",
+		ActiveChecks:                false,
+		ChecksInterval:              12 * time.Hour,
+		CheckCommand:                "dummy",
+		MaxCheckAttempts:            1,
 	}
 	mockCfg := &MockConfiguration{
 		config: signaliloCfg,
+		stats:  stats.New(),
 	}
 	log := MockLogger(mockCfg.config.LogLevel)
 	mockCfg.logger = log
-	ConfigInitialize(mockCfg)
+	_ = ConfigInitialize(mockCfg)
 	// reset logger to the MockLogger, since ConfigInitialize overwrites
 	// the logger.
 	mockCfg.logger = log
@@ -0,0 +1,105 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package endpoint
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+// ListServicesWithAttrs lists the services matching query, but only
+// requests the given attributes from the Icinga API. This considerably
+// reduces the size of the response for hosts with many services. All other
+// attributes of the returned services are empty.
+func (m *Manager) ListServicesWithAttrs(query icinga2.QueryFilter, attrs []string) (services []icinga2.Service, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		services, err = listServicesWithAttrs(c, query, attrs)
+		return err
+	})
+	return services, err
+}
+
+// listServicesWithAttrs implements ListServicesWithAttrs for a single
+// client. Clients other than the Icinga API web client return all
+// attributes.
+func listServicesWithAttrs(c icinga2.Client, query icinga2.QueryFilter, attrs []string) ([]icinga2.Service, error) {
+	wc, ok := c.(*icinga2.WebClient)
+	if !ok {
+		return c.ListServices(query)
+	}
+	// The zone is needed to filter the services like ListServices does
+	if wc.Zone != "" {
+		attrs = append(append([]string{}, attrs...), "zone")
+	}
+	params := url.Values{"attrs": attrs}
+
+	var results icinga2.ServiceResults
+	resp, err := wc.FilteredQuery(wc.URL+"/v1/objects/services?"+params.Encode(), query, &results, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.HttpResponse().StatusCode != 200 {
+		return nil, fmt.Errorf("Did not get 200 OK")
+	}
+	services := make([]icinga2.Service, 0, len(results.Results))
+	for _, result := range results.Results {
+		if wc.Zone == "" || wc.Zone == result.Service.Zone {
+			services = append(services, result.Service)
+		}
+	}
+	return services, nil
+}
+
+// UpdateServiceVars sets the given variables of the service with the full
+// name name in Icinga, without modifying any other attribute
+func (m *Manager) UpdateServiceVars(name string, vars icinga2.Vars) error {
+	return m.doMutating(func(c icinga2.Client) error { return updateServiceVars(c, name, vars) })
+}
+
+// UpdateServiceVars sets the given variables of the service with the full
+// name name through c. Icinga rejects updates of attributes such as state,
+// so only the variables are sent, which also avoids overwriting concurrent
+// changes of other attributes.
+func UpdateServiceVars(c icinga2.Client, name string, vars icinga2.Vars) error {
+	if m, ok := c.(*Manager); ok {
+		return m.UpdateServiceVars(name, vars)
+	}
+	return updateServiceVars(c, name, vars)
+}
+
+// updateServiceVars implements UpdateServiceVars for a single client.
+// Clients other than the Icinga API web client are updated with the whole
+// service.
+func updateServiceVars(c icinga2.Client, name string, vars icinga2.Vars) error {
+	wc, ok := c.(*icinga2.WebClient)
+	if !ok {
+		svc, err := c.GetService(name)
+		if err != nil {
+			return err
+		}
+		merged := icinga2.Vars{}
+		for k, v := range svc.Vars {
+			merged[k] = v
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+		svc.Vars = merged
+		svc.Templates = nil
+		return c.UpdateService(svc)
+	}
+	attrs := map[string]interface{}{}
+	for k, v := range icinga2.Flatten(vars) {
+		attrs["vars."+k] = v
+	}
+	return wc.UpdateObject("/services/"+name, map[string]interface{}{"attrs": attrs})
+}
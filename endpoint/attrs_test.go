@@ -0,0 +1,93 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/logging"
+)
+
+func TestListServicesWithAttrs(t *testing.T) {
+	var gotAttrs []string
+	var gotFilter icinga2.QueryFilter
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAttrs = r.URL.Query()["attrs"]
+		_ = json.NewDecoder(r.Body).Decode(&gotFilter)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"results":[
+			{"attrs":{"name":"a","host_name":"host","vars":{"bridge_uuid":"uuid"}}},
+			{"attrs":{"name":"b","host_name":"host","vars":{"bridge_uuid":"uuid"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	factory := func(u string) (icinga2.Client, error) {
+		return icinga2.New(icinga2.WebClient{URL: u})
+	}
+	m, err := New([]string{server.URL}, factory, Options{HealthCheckInterval: time.Second}, logging.NewDiscard(0))
+	assert.NoError(t, err)
+
+	query := icinga2.QueryFilter{Filter: `service.host_name == "host"`}
+	services, err := m.ListServicesWithAttrs(query, []string{"name", "vars"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name", "vars"}, gotAttrs)
+	assert.Equal(t, query, gotFilter)
+	assert.Len(t, services, 2)
+	assert.Equal(t, "b", services[1].Name)
+	assert.Equal(t, "uuid", services[1].Vars["bridge_uuid"])
+}
+
+func TestListServicesWithAttrsFallback(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665")
+	clients["https://master:5665"].Services["host!other"] = icinga2.Service{Name: "other", HostName: "host"}
+
+	services, err := m.ListServicesWithAttrs(icinga2.QueryFilter{}, []string{"name"})
+	assert.NoError(t, err)
+	assert.Len(t, services, 2, "clients other than the web client return all services")
+}
+
+func TestUpdateServiceVars(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"results":[{"code":200,"status":"Attributes updated."}]}`)
+	}))
+	defer server.Close()
+
+	factory := func(u string) (icinga2.Client, error) {
+		return icinga2.New(icinga2.WebClient{URL: u})
+	}
+	m, err := New([]string{server.URL}, factory, Options{HealthCheckInterval: time.Second}, logging.NewDiscard(0))
+	assert.NoError(t, err)
+
+	assert.NoError(t, UpdateServiceVars(m, "host!svc", icinga2.Vars{"bridge_uuid": "uuid"}))
+	assert.Equal(t, "/v1/objects/services/host!svc", gotPath)
+	assert.Equal(t, map[string]map[string]interface{}{"attrs": {"vars.bridge_uuid": "uuid"}}, gotBody, "only the variables are updated")
+}
+
+func TestUpdateServiceVarsFallback(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665")
+	clients["https://master:5665"].Services["host!svc"] = icinga2.Service{Name: "svc", HostName: "host", Vars: icinga2.Vars{"a": "1"}}
+
+	assert.NoError(t, UpdateServiceVars(m, "host!svc", icinga2.Vars{"b": "2"}))
+	assert.Equal(t, icinga2.Vars{"a": "1", "b": "2"}, clients["https://master:5665"].Services["host!svc"].Vars)
+	assert.Error(t, UpdateServiceVars(m, "host!missing", icinga2.Vars{"b": "2"}))
+}
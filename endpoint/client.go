@@ -0,0 +1,157 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package endpoint
+
+import (
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+// GetHost implements icinga2.Client
+func (m *Manager) GetHost(name string) (host icinga2.Host, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		host, err = c.GetHost(name)
+		return err
+	})
+	return host, err
+}
+
+// CreateHost implements icinga2.Client
+func (m *Manager) CreateHost(host icinga2.Host) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.CreateHost(host) })
+}
+
+// ListHosts implements icinga2.Client
+func (m *Manager) ListHosts(query string) (hosts []icinga2.Host, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		hosts, err = c.ListHosts(query)
+		return err
+	})
+	return hosts, err
+}
+
+// DeleteHost implements icinga2.Client
+func (m *Manager) DeleteHost(name string) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.DeleteHost(name) })
+}
+
+// UpdateHost implements icinga2.Client
+func (m *Manager) UpdateHost(host icinga2.Host) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.UpdateHost(host) })
+}
+
+// GetHostGroup implements icinga2.Client
+func (m *Manager) GetHostGroup(name string) (group icinga2.HostGroup, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		group, err = c.GetHostGroup(name)
+		return err
+	})
+	return group, err
+}
+
+// CreateHostGroup implements icinga2.Client
+func (m *Manager) CreateHostGroup(group icinga2.HostGroup) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.CreateHostGroup(group) })
+}
+
+// ListHostGroups implements icinga2.Client
+func (m *Manager) ListHostGroups(query string) (groups []icinga2.HostGroup, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		groups, err = c.ListHostGroups(query)
+		return err
+	})
+	return groups, err
+}
+
+// DeleteHostGroup implements icinga2.Client
+func (m *Manager) DeleteHostGroup(name string) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.DeleteHostGroup(name) })
+}
+
+// UpdateHostGroup implements icinga2.Client
+func (m *Manager) UpdateHostGroup(group icinga2.HostGroup) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.UpdateHostGroup(group) })
+}
+
+// ListDowntimes implements icinga2.Client
+func (m *Manager) ListDowntimes(query icinga2.QueryFilter) (downtimes []icinga2.Downtime, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		downtimes, err = c.ListDowntimes(query)
+		return err
+	})
+	return downtimes, err
+}
+
+// GetService implements icinga2.Client
+func (m *Manager) GetService(name string) (svc icinga2.Service, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		svc, err = c.GetService(name)
+		return err
+	})
+	return svc, err
+}
+
+// CreateService implements icinga2.Client
+func (m *Manager) CreateService(svc icinga2.Service) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.CreateService(svc) })
+}
+
+// ListServices implements icinga2.Client
+func (m *Manager) ListServices(query icinga2.QueryFilter) (services []icinga2.Service, err error) {
+	err = m.do(func(c icinga2.Client) (err error) {
+		services, err = c.ListServices(query)
+		return err
+	})
+	return services, err
+}
+
+// DeleteService implements icinga2.Client
+func (m *Manager) DeleteService(name string) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.DeleteService(name) })
+}
+
+// UpdateService implements icinga2.Client
+func (m *Manager) UpdateService(svc icinga2.Service) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.UpdateService(svc) })
+}
+
+// ProcessCheckResult implements icinga2.Client
+func (m *Manager) ProcessCheckResult(svc icinga2.Service, action icinga2.Action) error {
+	return m.doMutating(func(c icinga2.Client) error { return c.ProcessCheckResult(svc, action) })
+}
+
+// GetClientConfig implements icinga2.Client by returning the configuration
+// of the active endpoint's client
+func (m *Manager) GetClientConfig() icinga2.ClientConfig {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	cfg := m.endpoints[m.active].client.GetClientConfig()
+	cfg.URL = m.endpoints[m.active].url
+	return cfg
+}
+
+// TestIcingaApi implements icinga2.Client by testing the active endpoint,
+// failing over if it can't be reached
+func (m *Manager) TestIcingaApi() error {
+	return m.do(func(c icinga2.Client) error { return c.TestIcingaApi() })
+}
+
+// SetIcingaUrl implements icinga2.Client by switching to the endpoint with
+// the given URL. URLs which aren't configured are ignored.
+func (m *Manager) SetIcingaUrl(url string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, ep := range m.endpoints {
+		if ep.url == url {
+			m.switchTo(i, "requested explicitly")
+			return
+		}
+	}
+	m.logger.Errorf("Not switching to unknown Icinga API %v", url)
+}
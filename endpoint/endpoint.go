@@ -0,0 +1,391 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package endpoint manages the connections to multiple Icinga API endpoints
+// and fails over between them.
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bketelsen/logr"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/logging"
+)
+
+// ClientFactory creates an Icinga API client for the given URL
+type ClientFactory func(url string) (icinga2.Client, error)
+
+// Options configure the health checking and failover behavior of a Manager
+type Options struct {
+	// HealthCheckInterval is the interval in which each endpoint is
+	// checked
+	HealthCheckInterval time.Duration
+	// FailbackDelay is how long the first endpoint, which is the Icinga
+	// config master, must be healthy before the Manager switches back to
+	// it
+	FailbackDelay time.Duration
+	// OnSwitch is called with the URLs of the previous and the new active
+	// endpoint whenever the Manager switches endpoints, if it's set
+	OnSwitch func(from, to, reason string)
+}
+
+// Status describes the health of a single endpoint
+type Status struct {
+	URL          string    `json:"url"`
+	Active       bool      `json:"active"`
+	Healthy      bool      `json:"healthy"`
+	HealthySince time.Time `json:"healthy_since"`
+	LastCheck    time.Time `json:"last_check"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Switch describes a switch of the active endpoint
+type Switch struct {
+	Timestamp time.Time `json:"timestamp"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+}
+
+// maxHistory is the number of endpoint switches kept by the Manager
+const maxHistory = 20
+
+type endpoint struct {
+	url          string
+	client       icinga2.Client
+	healthy      bool
+	healthySince time.Time
+	lastCheck    time.Time
+	lastError    error
+}
+
+// Manager implements icinga2.Client on top of one client per configured
+// Icinga API URL. Requests are sent to the active endpoint. If a request
+// fails because the endpoint can't be reached, the Manager immediately fails
+// over to the next healthy endpoint and retries the request there. Requests
+// which change objects in Icinga are only retried if they can't have
+// reached Icinga. The first endpoint is preferred and becomes active again
+// once it has been healthy for FailbackDelay. Manager is safe for concurrent
+// use.
+type Manager struct {
+	mutex     sync.RWMutex
+	endpoints []*endpoint
+	active    int
+	history   []Switch
+	options   Options
+	logger    logr.Logger
+}
+
+// New creates a Manager for the given URLs. The first URL is the preferred
+// endpoint.
+func New(urls []string, factory ClientFactory, options Options, l logr.Logger) (*Manager, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no Icinga API URL configured")
+	}
+	m := &Manager{
+		options: options,
+		logger:  l,
+	}
+	for _, u := range urls {
+		client, err := factory(u)
+		if err != nil {
+			return nil, fmt.Errorf("creating client for %v: %w", u, err)
+		}
+		m.endpoints = append(m.endpoints, &endpoint{url: u, client: client})
+	}
+	return m, nil
+}
+
+// IsEndpointError returns true if err indicates that the Icinga API endpoint
+// couldn't be reached, as opposed to an error reported by the Icinga API
+func IsEndpointError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// IsConnectError returns true if err indicates that no connection to the
+// Icinga API endpoint could be established, so a request can't have
+// reached Icinga
+func IsConnectError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// Probe checks all endpoints once and activates the first healthy one. An
+// error is returned if no endpoint is healthy.
+func (m *Manager) Probe() error {
+	var wg sync.WaitGroup
+	for i := range m.endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.check(i, time.Now())
+		}(i)
+	}
+	wg.Wait()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, ep := range m.endpoints {
+		if ep.healthy {
+			m.logger.WithField(logging.FieldEndpoint, ep.url).Infof("Using Icinga API %v", ep.url)
+			m.active = i
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid Icinga API URL found")
+}
+
+// Run health-checks each endpoint in its own goroutine until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range m.endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ticker := time.NewTicker(m.options.HealthCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ts := <-ticker.C:
+					m.check(i, ts)
+					m.reconcile(ts)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// check runs a health check against endpoint i
+func (m *Manager) check(i int, ts time.Time) {
+	ep := m.endpoints[i]
+	err := ep.client.TestIcingaApi()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ep.lastCheck = ts
+	ep.lastError = err
+	if err != nil {
+		if ep.healthy {
+			m.logger.WithField(logging.FieldEndpoint, ep.url).Errorf("Icinga API %v is unhealthy: %v", ep.url, err)
+		}
+		ep.healthy = false
+		return
+	}
+	if !ep.healthy {
+		m.logger.WithField(logging.FieldEndpoint, ep.url).Infof("Icinga API %v is healthy", ep.url)
+		ep.healthy = true
+		ep.healthySince = ts
+	}
+}
+
+// reconcile switches away from an unhealthy active endpoint and back to the
+// preferred endpoint once it has been healthy for long enough
+func (m *Manager) reconcile(ts time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.endpoints[m.active].healthy {
+		if next, ok := m.nextHealthy(); ok {
+			m.switchTo(next, "active endpoint failed health check")
+		}
+		return
+	}
+	preferred := m.endpoints[0]
+	if m.active != 0 && preferred.healthy && ts.Sub(preferred.healthySince) >= m.options.FailbackDelay {
+		m.switchTo(0, fmt.Sprintf("config master healthy for %v", ts.Sub(preferred.healthySince).Round(time.Second)))
+	}
+}
+
+// nextHealthy returns the first healthy endpoint in configuration order.
+// Must be called with the mutex held.
+func (m *Manager) nextHealthy() (int, bool) {
+	for i, ep := range m.endpoints {
+		if ep.healthy {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// switchTo activates endpoint i. Must be called with the mutex held.
+func (m *Manager) switchTo(i int, reason string) {
+	if i == m.active {
+		return
+	}
+	m.logger.WithField(logging.FieldOperation, "failover").WithField(logging.FieldEndpoint, m.endpoints[i].url).
+		Infof("Switching Icinga API from %v to %v: %v", m.endpoints[m.active].url, m.endpoints[i].url, reason)
+	if m.options.OnSwitch != nil {
+		m.options.OnSwitch(m.endpoints[m.active].url, m.endpoints[i].url, reason)
+	}
+	m.history = append(m.history, Switch{
+		Timestamp: time.Now(),
+		From:      m.endpoints[m.active].url,
+		To:        m.endpoints[i].url,
+		Reason:    reason,
+	})
+	if len(m.history) > maxHistory {
+		m.history = m.history[len(m.history)-maxHistory:]
+	}
+	m.active = i
+}
+
+// markFailed records that a request to endpoint i failed because the
+// endpoint couldn't be reached, and fails over to the next healthy
+// endpoint
+func (m *Manager) markFailed(i int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ep := m.endpoints[i]
+	ep.healthy = false
+	ep.lastError = err
+	if i == m.active {
+		if next, ok := m.nextHealthy(); ok {
+			m.switchTo(next, fmt.Sprintf("request failed: %v", err))
+		}
+	}
+}
+
+// markReachable records that endpoint i answered a request. If the active
+// endpoint is unhealthy, endpoint i becomes the active endpoint.
+func (m *Manager) markReachable(i int, ts time.Time) {
+	m.mutex.RLock()
+	upToDate := m.endpoints[i].healthy && m.endpoints[m.active].healthy
+	m.mutex.RUnlock()
+	if upToDate {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ep := m.endpoints[i]
+	if !ep.healthy {
+		ep.healthy = true
+		ep.healthySince = ts
+		ep.lastError = nil
+	}
+	if !m.endpoints[m.active].healthy {
+		m.switchTo(i, "request to active endpoint failed")
+	}
+}
+
+// candidates returns the endpoints to try for a request in order: the
+// active endpoint, then the healthy and finally the unhealthy endpoints
+func (m *Manager) candidates() []int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	order := []int{m.active}
+	for _, wantHealthy := range []bool{true, false} {
+		for i, ep := range m.endpoints {
+			if i != m.active && ep.healthy == wantHealthy {
+				order = append(order, i)
+			}
+		}
+	}
+	return order
+}
+
+// do runs request against the active endpoint, failing over to the other
+// endpoints if the active endpoint can't be reached
+func (m *Manager) do(request func(icinga2.Client) error) error {
+	return m.try(request, IsEndpointError)
+}
+
+// doMutating runs request, which changes objects in Icinga, like do. As
+// the request may have reached Icinga if the endpoint failed after the
+// connection was established, e.g. with a timeout, it's only retried on
+// the other endpoints if the connection couldn't be established.
+func (m *Manager) doMutating(request func(icinga2.Client) error) error {
+	return m.try(request, IsConnectError)
+}
+
+// try runs request against the candidate endpoints until it succeeds, or
+// fails with an error for which retry returns false
+func (m *Manager) try(request func(icinga2.Client) error, retry func(error) bool) error {
+	var err error
+	for _, i := range m.candidates() {
+		err = request(m.endpoints[i].client)
+		if !IsEndpointError(err) {
+			m.markReachable(i, time.Now())
+			return err
+		}
+		m.logger.WithField(logging.FieldEndpoint, m.endpoints[i].url).Errorf("Icinga API %v unreachable: %v", m.endpoints[i].url, err)
+		m.markFailed(i, err)
+		if !retry(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Connected returns true if at least one endpoint is healthy
+func (m *Manager) Connected() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.nextHealthy()
+	return ok
+}
+
+// ActiveURL returns the URL of the active endpoint
+func (m *Manager) ActiveURL() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.endpoints[m.active].url
+}
+
+// Status returns the health of all endpoints in configuration order
+func (m *Manager) Status() []Status {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	status := make([]Status, 0, len(m.endpoints))
+	for i, ep := range m.endpoints {
+		s := Status{
+			URL:          ep.url,
+			Active:       i == m.active,
+			Healthy:      ep.healthy,
+			HealthySince: ep.healthySince,
+			LastCheck:    ep.lastCheck,
+		}
+		if ep.lastError != nil {
+			s.LastError = ep.lastError.Error()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// History returns the most recent switches of the active endpoint, newest
+// first
+func (m *Manager) History() []Switch {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	history := make([]Switch, 0, len(m.history))
+	for i := len(m.history) - 1; i >= 0; i-- {
+		history = append(history, m.history[i])
+	}
+	return history
+}
@@ -0,0 +1,202 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/logging"
+)
+
+// fakeClient is a mock Icinga client which can be made unreachable, or
+// time out after the request has been sent
+type fakeClient struct {
+	*icinga2.MockClient
+	mutex    sync.Mutex
+	down     bool
+	timeout  bool
+	requests int
+}
+
+func (f *fakeClient) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+}
+
+func (f *fakeClient) request() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests++
+	if f.down {
+		return &url.Error{Op: "Get", URL: f.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}}
+	}
+	if f.timeout {
+		return &url.Error{Op: "Post", URL: f.URL, Err: context.DeadlineExceeded}
+	}
+	return nil
+}
+
+func (f *fakeClient) TestIcingaApi() error {
+	return f.request()
+}
+
+func (f *fakeClient) ProcessCheckResult(svc icinga2.Service, action icinga2.Action) error {
+	if err := f.request(); err != nil {
+		return err
+	}
+	return f.MockClient.ProcessCheckResult(svc, action)
+}
+
+func (f *fakeClient) GetService(name string) (icinga2.Service, error) {
+	if err := f.request(); err != nil {
+		return icinga2.Service{}, err
+	}
+	return f.MockClient.GetService(name)
+}
+
+func newTestManager(t *testing.T, urls ...string) (*Manager, map[string]*fakeClient) {
+	clients := map[string]*fakeClient{}
+	factory := func(u string) (icinga2.Client, error) {
+		c := &fakeClient{MockClient: icinga2.NewMockClient()}
+		c.SetIcingaUrl(u)
+		c.Services["host!svc"] = icinga2.Service{Name: "svc", HostName: "host", Notes: u}
+		clients[u] = c
+		return c, nil
+	}
+	m, err := New(urls, factory, Options{HealthCheckInterval: time.Second, FailbackDelay: 5 * time.Minute}, logging.NewDiscard(0))
+	assert.NoError(t, err)
+	return m, clients
+}
+
+func TestProbe(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665", "https://satellite:5665")
+	clients["https://master:5665"].setDown(true)
+	assert.NoError(t, m.Probe())
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL(), "first healthy endpoint is active")
+
+	assert.True(t, m.Connected())
+
+	clients["https://satellite:5665"].setDown(true)
+	assert.Error(t, m.Probe(), "no healthy endpoint")
+	assert.False(t, m.Connected())
+}
+
+func TestRequestFailover(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665", "https://satellite:5665")
+	var switches []string
+	m.options.OnSwitch = func(from, to, reason string) { switches = append(switches, from+" -> "+to) }
+	assert.NoError(t, m.Probe())
+	assert.Equal(t, "https://master:5665", m.ActiveURL())
+
+	clients["https://master:5665"].setDown(true)
+	svc, err := m.GetService("host!svc")
+	assert.NoError(t, err, "request is retried on the next endpoint")
+	assert.Equal(t, "https://satellite:5665", svc.Notes)
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL(), "failed over immediately")
+	assert.Equal(t, "https://satellite:5665", m.GetClientConfig().URL)
+	assert.Equal(t, []string{"https://master:5665 -> https://satellite:5665"}, switches)
+	if history := m.History(); assert.Len(t, history, 1) {
+		assert.Equal(t, "https://master:5665", history[0].From)
+		assert.Equal(t, "https://satellite:5665", history[0].To)
+		assert.NotEmpty(t, history[0].Reason)
+	}
+
+	_, err = m.GetService("host!unknown")
+	assert.Error(t, err, "API errors are returned")
+	assert.False(t, IsEndpointError(err))
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL(), "API errors don't cause a failover")
+
+	clients["https://satellite:5665"].setDown(true)
+	_, err = m.GetService("host!svc")
+	assert.True(t, IsEndpointError(err), "all endpoints down")
+}
+
+func TestMutatingRequestFailover(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665", "https://satellite:5665")
+	assert.NoError(t, m.Probe())
+	svc := icinga2.Service{Name: "svc", HostName: "host"}
+
+	clients["https://master:5665"].setDown(true)
+	assert.NoError(t, m.ProcessCheckResult(svc, icinga2.Action{}), "requests which can't have reached Icinga are retried")
+	assert.Len(t, clients["https://satellite:5665"].Actions["host!svc"], 1)
+
+	clients["https://satellite:5665"].mutex.Lock()
+	clients["https://satellite:5665"].timeout = true
+	clients["https://satellite:5665"].mutex.Unlock()
+	clients["https://master:5665"].setDown(false)
+	err := m.ProcessCheckResult(svc, icinga2.Action{})
+	assert.True(t, IsEndpointError(err), "requests which may have reached Icinga aren't retried")
+	assert.Empty(t, clients["https://master:5665"].Actions["host!svc"])
+}
+
+func TestIsConnectError(t *testing.T) {
+	assert.True(t, IsConnectError(&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}))
+	assert.True(t, IsConnectError(&url.Error{Op: "Post", Err: &net.DNSError{Err: "no such host"}}))
+	assert.False(t, IsConnectError(&url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: fmt.Errorf("connection reset")}}))
+	assert.False(t, IsConnectError(&url.Error{Op: "Post", Err: context.DeadlineExceeded}))
+	assert.False(t, IsConnectError(fmt.Errorf("API error")))
+}
+
+func TestFailback(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665", "https://satellite:5665")
+	master := clients["https://master:5665"]
+	master.setDown(true)
+	assert.NoError(t, m.Probe())
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL())
+
+	ts := time.Now()
+	master.setDown(false)
+	m.check(0, ts)
+	m.reconcile(ts)
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL(), "no failback before failback delay")
+
+	m.check(0, ts.Add(5*time.Minute))
+	m.reconcile(ts.Add(5 * time.Minute))
+	assert.Equal(t, "https://master:5665", m.ActiveURL(), "failback after failback delay")
+
+	master.setDown(true)
+	m.check(0, ts.Add(6*time.Minute))
+	m.reconcile(ts.Add(6 * time.Minute))
+	assert.Equal(t, "https://satellite:5665", m.ActiveURL(), "failover on failed health check")
+
+	status := m.Status()
+	assert.Len(t, status, 2)
+	assert.False(t, status[0].Healthy)
+	assert.Contains(t, status[0].LastError, "connection refused")
+	assert.True(t, status[1].Active)
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	m, clients := newTestManager(t, "https://master:5665", "https://satellite:5665")
+	assert.NoError(t, m.Probe())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 10 {
+				clients["https://master:5665"].setDown(true)
+			}
+			_, err := m.GetService("host!svc")
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/logging"
+)
+
+// configureIcingaFlags adds the flags which identify the Signalilo instance
+// and configure the connection to the Icinga API to cmd. These flags are
+// shared by all commands which talk to Icinga.
+func configureIcingaFlags(cmd *kingpin.CmdClause, c *config.SignaliloConfig) {
+	// General configuration
+	cmd.Flag("uuid", "Instance UUID").Envar("SIGNALILO_UUID").Required().StringVar(&c.UUID)
+	cmd.Flag("loglevel", "Signalilo Loglevel").Envar("SIGNALILO_LOG_LEVEL").Default("2").IntVar(&c.LogLevel)
+	cmd.Flag("log_format", "Log output format, one of "+strings.Join(logging.Formats, ", ")).Envar("SIGNALILO_LOG_FORMAT").Default(logging.FormatJSON).EnumVar(&c.LogFormat, logging.Formats...)
+	logOutput := c.LogOutput
+	if logOutput == "" {
+		logOutput = config.LogOutputStdout
+	}
+	cmd.Flag("log_output", "Where logs are written to: stdout, stderr, or the path of a file which logs are appended to").Envar("SIGNALILO_LOG_OUTPUT").Default(logOutput).StringVar(&c.LogOutput)
+	cmd.Flag("audit_log", "Path of the audit log of changes made in Icinga, - for stdout").Envar("SIGNALILO_AUDIT_LOG").StringVar(&c.AuditLogPath)
+
+	// Icinga2 client configuration
+	cmd.Flag("icinga_hostname", "Icinga Servicehost Name").Envar("SIGNALILO_ICINGA_HOSTNAME").Required().StringVar(&c.HostName)
+	cmd.Flag("icinga_url", "Icinga API URL (can be repeated)").Envar("SIGNALILO_ICINGA_URL").Required().StringsVar(&c.IcingaConfig.URL)
+	cmd.Flag("icinga_username", "Icinga Username").Envar("SIGNALILO_ICINGA_USERNAME").Required().StringVar(&c.IcingaConfig.User)
+	cmd.Flag("icinga_password", "Icinga Password").Envar("SIGNALILO_ICINGA_PASSWORD").Required().StringVar(&c.IcingaConfig.Password)
+	cmd.Flag("icinga_insecure_tls", "Skip Icinga TLS verification").Envar("SIGNALILO_ICINGA_INSECURE_TLS").Default("false").BoolVar(&c.IcingaConfig.InsecureTLS)
+	cmd.Flag("icinga_x509_verify_cn", "Use CN when verifying certificates. Overrides the default go1.15 behavior of rejecting certificates without matching SAN.").Envar("SIGNALILO_ICINGA_X509_VERIFY_CN").Default("true").BoolVar(&c.IcingaConfig.X509VerifyCN)
+	cmd.Flag("icinga_disable_keepalives", "Disable HTTP keepalives").Envar("SIGNALILO_ICINGA_DISABLE_KEEPALIVES").Default("false").BoolVar(&c.IcingaConfig.DisableKeepAlives)
+	cmd.Flag("icinga_debug", "Enable debug-level logging for icinga2 client library").Envar("SIGNALILO_ICINGA_DEBUG").Default("false").BoolVar(&c.IcingaConfig.Debug)
+	cmd.Flag("icinga_ca", "A custom CA certificate to use when connecting to the Icinga API").Envar("SIGNALILO_ICINGA_CA").StringVar(&c.CAData)
+	cmd.Flag("icinga_health_check_interval", "Interval in which each Icinga API URL is health-checked").Envar("SIGNALILO_ICINGA_HEALTH_CHECK_INTERVAL").Default("30s").DurationVar(&c.IcingaConfig.HealthCheckInterval)
+	cmd.Flag("icinga_failback_delay", "How long the first Icinga API URL must be healthy before Signalilo switches back to it").Envar("SIGNALILO_ICINGA_FAILBACK_DELAY").Default("5m").DurationVar(&c.IcingaConfig.FailbackDelay)
+	cmd.Flag("icinga_reconnect", "Deprecated: use --icinga_failback_delay. No longer delays switching away from an unreachable Icinga API URL, only used as failback delay if it's longer than --icinga_failback_delay.").Envar("SIGNALILO_ICINGA_RECONNECT").Default("0").DurationVar(&c.Reconnect)
+}
+
+// configureGCFlags adds the flags which configure the garbage collector to
+// cmd
+func configureGCFlags(cmd *kingpin.CmdClause, c *config.SignaliloConfig) {
+	cmd.Flag("icinga_max_age", "Delete services which aren't OK and haven't been updated by an alert for this long. 0 never deletes services which aren't OK").Envar("SIGNALILO_ICINGA_MAX_AGE").Default("0").DurationVar(&c.MaxAge)
+	cmd.Flag("icinga_gc_quarantine", "Set the variable signalilo_quarantine on managed services whose variables are malformed, so they can be found in Icinga").Envar("SIGNALILO_ICINGA_GC_QUARANTINE").Default("false").BoolVar(&c.GCQuarantine)
+	configurePreviousUUIDFlag(cmd, c)
+	cmd.Flag("icinga_gc_concurrency", "Maximum number of services which the garbage collector deletes concurrently").Envar("SIGNALILO_ICINGA_GC_CONCURRENCY").Default("8").IntVar(&c.GCConcurrency)
+}
+
+// configurePreviousUUIDFlag adds the flag which lists the previous UUIDs of
+// the Signalilo instance to cmd
+func configurePreviousUUIDFlag(cmd *kingpin.CmdClause, c *config.SignaliloConfig) {
+	cmd.Flag("previous_uuid", "Previous instance UUID whose services are taken over by this instance (can be repeated)").Envar("SIGNALILO_PREVIOUS_UUID").StringsVar(&c.PreviousUUIDs)
+}
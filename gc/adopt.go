@@ -0,0 +1,123 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package gc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/logging"
+	"github.com/vshn/signalilo/tracing"
+)
+
+// AdoptAction is what Adopt does with the services of a previous UUID
+type AdoptAction string
+
+const (
+	// AdoptTakeOver sets the bridge UUID of the services to the UUID of
+	// this Signalilo, so they're garbage collected as usual
+	AdoptTakeOver AdoptAction = "take-over"
+	// AdoptDelete deletes the services
+	AdoptDelete AdoptAction = "delete"
+)
+
+// AdoptedService describes how a single service of a previous UUID was
+// adopted
+type AdoptedService struct {
+	Name     string      `json:"name"`
+	FromUUID string      `json:"from_uuid"`
+	State    int         `json:"state"`
+	Action   AdoptAction `json:"action"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// AdoptReport is the result of adopting the services of previous UUIDs
+type AdoptReport struct {
+	Timestamp time.Time        `json:"timestamp"`
+	DryRun    bool             `json:"dry_run"`
+	Host      string           `json:"host"`
+	UUID      string           `json:"uuid"`
+	FromUUIDs []string         `json:"from_uuids"`
+	Action    AdoptAction      `json:"action"`
+	Services  []AdoptedService `json:"services"`
+	Adopted   int              `json:"adopted"`
+	Errors    int              `json:"errors"`
+}
+
+// Adopt takes over or deletes the services on the configured host which
+// are managed by a Signalilo with one of fromUUIDs, e.g. because the
+// instance was redeployed with a new UUID. In a dry run, the services are
+// only listed.
+func Adopt(ctx context.Context, ts time.Time, c config.Configuration, fromUUIDs []string, action AdoptAction, dryRun bool) (AdoptReport, error) {
+	ctx, span := tracing.Start(ctx, "adopt")
+	defer span.End()
+	l := c.GetLogger().WithField(logging.FieldOperation, "adopt")
+	icinga := c.GetIcingaClient()
+	hostname := c.GetConfig().HostName
+	uuid := c.GetConfig().UUID
+	report := AdoptReport{
+		Timestamp: ts,
+		DryRun:    dryRun,
+		Host:      hostname,
+		UUID:      uuid,
+		FromUUIDs: fromUUIDs,
+		Action:    action,
+		Services:  []AdoptedService{},
+	}
+	if action != AdoptTakeOver && action != AdoptDelete {
+		return report, fmt.Errorf("unknown adopt action %q", action)
+	}
+	for _, from := range fromUUIDs {
+		if from == uuid {
+			return report, fmt.Errorf("can't adopt services from the UUID of this instance %v", uuid)
+		}
+	}
+
+	for _, from := range fromUUIDs {
+		services, err := listManagedServices(ctx, icinga, hostname, from)
+		if err != nil {
+			l.Errorf("[Adopt] Error while listing services of UUID %v: %v", from, err)
+			return report, err
+		}
+		for _, svc := range services {
+			l := l.WithField(logging.FieldService, svc.Name)
+			adopted := AdoptedService{
+				Name:     svc.Name,
+				FromUUID: from,
+				State:    int(svc.State),
+				Action:   action,
+			}
+			switch {
+			case dryRun:
+				l.V(2).Infof("[Adopt] Would %v service %v of UUID %v", action, svc.Name, from)
+			case action == AdoptDelete:
+				l.V(2).Infof("[Adopt] Deleting service %v of UUID %v", svc.Name, from)
+				err = deleteService(ctx, svc, c, audit.TriggerAdopt, fmt.Sprintf("adopted from UUID %v", from))
+			default:
+				l.V(2).Infof("[Adopt] Taking over service %v of UUID %v", svc.Name, from)
+				err = setVar(ctx, svc, "bridge_uuid", uuid, c, audit.TriggerAdopt)
+			}
+			if err != nil {
+				l.Errorf("[Adopt] Unable to %v service %v: %v", action, svc.Name, err)
+				adopted.Error = err.Error()
+				report.Errors++
+			} else {
+				report.Adopted++
+			}
+			report.Services = append(report.Services, adopted)
+		}
+	}
+	l.Infof("[Adopt] Adopted %v services of UUIDs %v with action %v, %v errors, dry run=%v",
+		report.Adopted, fromUUIDs, action, report.Errors, dryRun)
+	return report, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+)
+
+const previousUUID = "0c4f1c8e-2b6d-4e55-9d0a-3f5f6c1e7a21"
+
+func previousService(name string, ts time.Time, age time.Duration) icinga2.Service {
+	return managedService(name, 0, ts, age, icinga2.Vars{"bridge_uuid": previousUUID})
+}
+
+func TestAdoptTakeOver(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		previousService("old", ts, 2*time.Hour),
+		managedService("ours", 0, ts, time.Minute, nil),
+		managedService("other", 0, ts, time.Minute, icinga2.Vars{"bridge_uuid": "other"}),
+	)
+
+	report, err := Adopt(context.Background(), ts, c, []string{previousUUID}, AdoptTakeOver, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Adopted)
+	assert.Equal(t, 0, report.Errors)
+	assert.Equal(t, []AdoptedService{{Name: "old", FromUUID: previousUUID, Action: AdoptTakeOver}}, report.Services)
+	assert.Equal(t, testUUID, icinga.Services["signalilo_test!old"].Vars["bridge_uuid"])
+	assert.Equal(t, float64(time.Hour), icinga.Services["signalilo_test!old"].Vars["keep_for"], "other variables are kept")
+	assert.Equal(t, "other", icinga.Services["signalilo_test!other"].Vars["bridge_uuid"])
+}
+
+func TestAdoptTakeOverIcingaAPI(t *testing.T) {
+	ts := time.Now()
+	c, _ := newTestConfiguration()
+	critical := managedService("critical", 2, ts, 2*time.Hour, icinga2.Vars{"bridge_uuid": previousUUID})
+	api, icinga := newIcingaAPI(t, critical)
+	c.SetIcingaClient(icinga)
+
+	report, err := Adopt(context.Background(), ts, c, []string{previousUUID}, AdoptTakeOver, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Adopted)
+	assert.Equal(t, 0, report.Errors, "only variables are updated on services which aren't OK")
+	svc := api.service("signalilo_test!critical")
+	assert.Equal(t, testUUID, svc.Vars["bridge_uuid"])
+	assert.Equal(t, float64(time.Hour), svc.Vars["keep_for"])
+	assert.Equal(t, critical.State, svc.State)
+	assert.Equal(t, critical.LastStateChange, svc.LastStateChange)
+}
+
+func TestAdoptDelete(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		previousService("old", ts, time.Minute),
+		managedService("ours", 0, ts, time.Minute, nil),
+	)
+
+	report, err := Adopt(context.Background(), ts, c, []string{previousUUID}, AdoptDelete, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Adopted)
+	assert.NotContains(t, icinga.Services, "signalilo_test!old")
+	assert.Contains(t, icinga.Services, "signalilo_test!ours")
+}
+
+func TestAdoptDryRun(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(previousService("old", ts, time.Minute))
+
+	for _, action := range []AdoptAction{AdoptTakeOver, AdoptDelete} {
+		report, err := Adopt(context.Background(), ts, c, []string{previousUUID}, action, true)
+		assert.NoError(t, err)
+		assert.True(t, report.DryRun)
+		assert.Equal(t, 1, report.Adopted)
+		assert.Equal(t, previousUUID, icinga.Services["signalilo_test!old"].Vars["bridge_uuid"])
+	}
+}
+
+func TestAdoptInvalid(t *testing.T) {
+	c, _ := newTestConfiguration()
+
+	_, err := Adopt(context.Background(), time.Now(), c, []string{testUUID}, AdoptTakeOver, false)
+	assert.Error(t, err, "services of the own UUID can't be adopted")
+	_, err = Adopt(context.Background(), time.Now(), c, []string{previousUUID}, AdoptAction("steal"), false)
+	assert.Error(t, err)
+}
+
+func TestRunAdoptsPreviousUUIDs(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		previousService("expired", ts, 2*time.Hour),
+		previousService("recent", ts, time.Minute),
+	)
+	c.GetConfig().PreviousUUIDs = []string{previousUUID}
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Adopted)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, 1, report.Kept)
+	assert.NotContains(t, icinga.Services, "signalilo_test!expired")
+	assert.Equal(t, testUUID, icinga.Services["signalilo_test!recent"].Vars["bridge_uuid"])
+}
+
+func TestRunAudit(t *testing.T) {
+	ts := time.Now()
+	c, _ := newTestConfiguration(
+		previousService("expired", ts, 2*time.Hour),
+		managedService("old", 0, ts, 2*time.Hour, nil),
+		managedService("recent", 0, ts, time.Minute, nil),
+	)
+	c.GetConfig().PreviousUUIDs = []string{previousUUID}
+	var buf bytes.Buffer
+	c.SetAuditLog(audit.New(&buf, testUUID))
+
+	_, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+
+	events := map[string][]audit.Event{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event audit.Event
+		if !assert.NoError(t, dec.Decode(&event)) {
+			return
+		}
+		events[event.Action] = append(events[event.Action], event)
+	}
+	if assert.Len(t, events[audit.ActionServiceUpdate], 1) {
+		update := events[audit.ActionServiceUpdate][0]
+		assert.Equal(t, audit.TriggerAdopt, update.Trigger)
+		assert.Equal(t, "signalilo_test!expired", update.Service)
+		assert.Equal(t, map[string]audit.Change{"vars.bridge_uuid": {Old: previousUUID, New: testUUID}}, update.Changes)
+	}
+	deleted := map[string]audit.Event{}
+	for _, event := range events[audit.ActionServiceDelete] {
+		deleted[event.Service] = event
+	}
+	assert.Len(t, deleted, 2)
+	for _, name := range []string{"signalilo_test!expired", "signalilo_test!old"} {
+		if assert.Contains(t, deleted, name) {
+			assert.Equal(t, audit.TriggerGC, deleted[name].Trigger)
+			assert.NotEmpty(t, deleted[name].Reason)
+		}
+	}
+}
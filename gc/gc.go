@@ -10,93 +10,440 @@
 package gc
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
 	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/logging"
+	"github.com/vshn/signalilo/stats"
+	"github.com/vshn/signalilo/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// extractDowntime searches the provided downtime array for a downtime for
-// service with name svcName.
-func extractDowntime(downtimes []icinga2.Downtime, svcName string) (icinga2.Downtime, bool) {
+// Decision is the outcome of garbage collecting a single service
+type Decision string
+
+const (
+	// DecisionDelete means that the service is (or, in a dry run, would
+	// be) deleted
+	DecisionDelete Decision = "delete"
+	// DecisionKeep means that the service is kept
+	DecisionKeep Decision = "keep"
+)
+
+// ServiceReport describes how a single managed service was garbage
+// collected
+type ServiceReport struct {
+	Name        string   `json:"name"`
+	State       int      `json:"state"`
+	Age         string   `json:"age"`
+	KeepFor     string   `json:"keep_for"`
+	SinceUpdate string   `json:"since_update,omitempty"`
+	Downtimed   bool     `json:"downtimed"`
+	Heartbeat   bool     `json:"heartbeat"`
+	Decision    Decision `json:"decision"`
+	Reason      string   `json:"reason"`
+	Malformed   bool     `json:"malformed,omitempty"`
+	Quarantined bool     `json:"quarantined,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Report is the result of a garbage collection run
+type Report struct {
+	Timestamp time.Time       `json:"timestamp"`
+	DryRun    bool            `json:"dry_run"`
+	Host      string          `json:"host"`
+	Duration  string          `json:"duration"`
+	Services  []ServiceReport `json:"services"`
+	Deleted   int             `json:"deleted"`
+	Kept      int             `json:"kept"`
+	Errors    int             `json:"errors"`
+	Malformed int             `json:"malformed"`
+	Adopted   int             `json:"adopted"`
+}
+
+// Summary returns the counters of the report
+func (r Report) Summary() stats.GCSummary {
+	return stats.GCSummary{
+		Deleted:   r.Deleted,
+		Kept:      r.Kept,
+		Errors:    r.Errors,
+		Malformed: r.Malformed,
+		Adopted:   r.Adopted,
+	}
+}
+
+// quarantineVar is set on malformed services if quarantining is enabled
+const quarantineVar = "signalilo_quarantine"
+
+// serviceAttrs are the service attributes which garbage collection and the
+// services API need
+var serviceAttrs = []string{"name", "display_name", "host_name", "state", "last_state_change", "vars"}
+
+// attrsLister is implemented by Icinga clients which can restrict the
+// service attributes returned by the Icinga API
+type attrsLister interface {
+	ListServicesWithAttrs(query icinga2.QueryFilter, attrs []string) ([]icinga2.Service, error)
+}
+
+// serviceFilter returns the Icinga filter expression which selects the
+// services on host which are managed by the Signalilo with uuid
+func serviceFilter(host, uuid string) string {
+	return fmt.Sprintf(`service.host_name == %q && service.vars.bridge_uuid == %q`, host, uuid)
+}
+
+// listManagedServices lists the services on host which are managed by the
+// Signalilo with uuid
+func listManagedServices(ctx context.Context, icinga icinga2.Client, host, uuid string) (managed []icinga2.Service, err error) {
+	_, span := tracing.StartIcingaCall(ctx, "list_services", icinga.GetClientConfig().URL)
+	defer func() { tracing.End(span, err) }()
+	query := icinga2.QueryFilter{Filter: serviceFilter(host, uuid)}
+	var services []icinga2.Service
+	if lister, ok := icinga.(attrsLister); ok {
+		services, err = lister.ListServicesWithAttrs(query, serviceAttrs)
+	} else {
+		services, err = icinga.ListServices(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Clients which don't support filtering return all services, so
+	// check the bridge UUID again
+	managed = make([]icinga2.Service, 0, len(services))
+	for _, svc := range services {
+		if svc.Vars["bridge_uuid"] == uuid {
+			managed = append(managed, svc)
+		}
+	}
+	return managed, nil
+}
+
+// indexDowntimes returns the names of the services which have a downtime
+func indexDowntimes(downtimes []icinga2.Downtime) map[string]bool {
+	index := make(map[string]bool, len(downtimes))
 	for _, dt := range downtimes {
-		if dt.Service == svcName {
-			return dt, true
+		index[dt.Service] = true
+	}
+	return index
+}
+
+// parseKeepFor parses the keep_for variable of a service. Signalilo stores
+// keep_for in nanoseconds, but services which were created or modified by
+// other tools may carry a duration string instead.
+func parseKeepFor(v interface{}) (time.Duration, error) {
+	var keepFor time.Duration
+	switch val := v.(type) {
+	case nil:
+		return 0, fmt.Errorf("keep_for missing")
+	case float64:
+		keepFor = time.Duration(int64(val))
+	case int:
+		keepFor = time.Duration(val)
+	case int64:
+		keepFor = time.Duration(val)
+	case time.Duration:
+		keepFor = val
+	case string:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			ns, nerr := strconv.ParseFloat(val, 64)
+			if nerr != nil {
+				return 0, fmt.Errorf("keep_for %q is neither a duration nor a number", val)
+			}
+			d = time.Duration(int64(ns))
 		}
+		keepFor = d
+	default:
+		return 0, fmt.Errorf("keep_for %v has unsupported type %T", val, val)
+	}
+	if keepFor < 0 {
+		return 0, fmt.Errorf("keep_for %v is negative", keepFor)
 	}
-	return icinga2.Downtime{}, false
+	return keepFor, nil
 }
 
-// collectService cleans up a single service that is managed by this Signalilo
-func collectService(svc icinga2.Service, c config.Configuration, downtimes []icinga2.Downtime) error {
-	l := c.GetLogger()
-	icinga := c.GetIcingaClient()
+// lastUpdate returns when Signalilo last updated svc. Services created by
+// older versions of Signalilo don't record their last update, which isn't
+// an error.
+func lastUpdate(svc icinga2.Service) (time.Time, bool, error) {
+	var ts float64
+	switch val := svc.Vars["signalilo_last_update"].(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case float64:
+		ts = val
+	case int64:
+		ts = float64(val)
+	case int:
+		ts = float64(val)
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("signalilo_last_update %q isn't a number", val)
+		}
+		ts = f
+	default:
+		return time.Time{}, false, fmt.Errorf("signalilo_last_update %v has unsupported type %T", val, val)
+	}
+	return time.Unix(int64(ts), 0), true, nil
+}
 
+// decide determines whether a single service that is managed by this
+// Signalilo should be deleted at ts. Services which aren't OK are deleted if
+// they haven't been updated for maxAge, unless maxAge is 0. Malformed
+// services are always kept.
+func decide(ts time.Time, svc icinga2.Service, downtimedServices map[string]bool, maxAge time.Duration) ServiceReport {
 	_, heartbeat := svc.Vars["label_heartbeat"]
-	_, downtimed := extractDowntime(downtimes, svc.Name)
-	if heartbeat && !downtimed {
-		l.V(2).Infof(fmt.Sprintf("[Collect] Skipping heartbeat %v: not downtimed", svc.Name))
-		return nil
-	} else if svc.State > 0 && !heartbeat {
-		l.V(2).Infof(fmt.Sprintf("[Collect] Skipping service %v: state=%v, downtimed=%v",
-			svc.Name, svc.State, downtimed))
-		return nil
-	}
-
-	keepForNs := int64(svc.Vars["keep_for"].(float64))
-	keepFor := time.Duration(keepForNs)
+	downtimed := downtimedServices[svc.Name]
+	report := ServiceReport{
+		Name:      svc.Name,
+		State:     int(svc.State),
+		Downtimed: downtimed,
+		Heartbeat: heartbeat,
+		Decision:  DecisionKeep,
+	}
+	_, report.Quarantined = svc.Vars[quarantineVar]
+
 	lastChangeUnixNs := int64(svc.LastStateChange * 1e9)
 	lastChange := time.Unix(0, lastChangeUnixNs)
-	serviceAge := time.Since(lastChange)
-	if serviceAge >= keepFor {
-		l.V(2).Infof("[Collect] Deleting service %v: keep_for = %v; age = %v", svc.Name, keepFor, serviceAge)
-		err := icinga.DeleteService(svc.FullName())
-		if err != nil {
-			l.Errorf(fmt.Sprintf("Error while deleting service: %v", err))
+	serviceAge := ts.Sub(lastChange)
+	report.Age = serviceAge.Round(time.Second).String()
+
+	keepFor, err := parseKeepFor(svc.Vars["keep_for"])
+	if err != nil {
+		report.Malformed = true
+		report.Reason = fmt.Sprintf("malformed: %v", err)
+		return report
+	}
+	report.KeepFor = keepFor.String()
+	updated, knownUpdate, err := lastUpdate(svc)
+	if err != nil {
+		report.Malformed = true
+		report.Reason = fmt.Sprintf("malformed: %v", err)
+		return report
+	}
+	sinceUpdate := ts.Sub(updated)
+	if knownUpdate {
+		report.SinceUpdate = sinceUpdate.Round(time.Second).String()
+	}
+
+	switch {
+	case heartbeat && !downtimed:
+		report.Reason = "heartbeat service which isn't downtimed"
+	case svc.State > 0 && !heartbeat && maxAge > 0 && knownUpdate && sinceUpdate >= maxAge:
+		report.Decision = DecisionDelete
+		report.Reason = fmt.Sprintf("stale: state=%v, not updated for %v, max age %v", svc.State, report.SinceUpdate, maxAge)
+	case svc.State > 0 && !heartbeat:
+		report.Reason = fmt.Sprintf("service isn't OK: state=%v, downtimed=%v", svc.State, downtimed)
+	case serviceAge < keepFor:
+		report.Reason = fmt.Sprintf("age %v is less than keep_for %v", report.Age, keepFor)
+	default:
+		report.Decision = DecisionDelete
+		report.Reason = fmt.Sprintf("age %v is at least keep_for %v", report.Age, keepFor)
+	}
+	return report
+}
+
+// setVar sets the variable key of svc to value in Icinga. The change is
+// recorded in the audit log as caused by trigger.
+func setVar(ctx context.Context, svc icinga2.Service, key string, value interface{}, c config.Configuration, trigger string) error {
+	// Only the variable is sent, as Icinga rejects updates of attributes
+	// such as the state and concurrent updates mustn't be overwritten
+	err := endpoint.UpdateServiceVars(c.GetIcingaClient(), svc.FullName(), icinga2.Vars{key: value})
+	recordAudit(ctx, c, audit.Event{
+		Action:  audit.ActionServiceUpdate,
+		Trigger: trigger,
+		Service: svc.FullName(),
+		Changes: map[string]audit.Change{"vars." + key: {Old: svc.Vars[key], New: value}},
+		Error:   audit.ErrorMessage(err),
+	})
+	return err
+}
+
+// deleteService deletes svc in Icinga. The deletion is recorded in the
+// audit log as caused by trigger.
+func deleteService(ctx context.Context, svc icinga2.Service, c config.Configuration, trigger, reason string) error {
+	err := c.GetIcingaClient().DeleteService(svc.FullName())
+	recordAudit(ctx, c, audit.Event{
+		Action:  audit.ActionServiceDelete,
+		Trigger: trigger,
+		Service: svc.FullName(),
+		Reason:  reason,
+		Error:   audit.ErrorMessage(err),
+	})
+	return err
+}
+
+// recordAudit records a change made in Icinga in the audit log
+func recordAudit(ctx context.Context, c config.Configuration, event audit.Event) {
+	if err := c.GetAuditLog().Record(ctx, event); err != nil {
+		c.GetLogger().Errorf("Unable to write audit log: %v", err)
+	}
+}
+
+// quarantine marks a malformed service with the quarantine variable, so it
+// can be found in Icinga
+func quarantine(ctx context.Context, svc icinga2.Service, reason string, c config.Configuration) error {
+	return setVar(ctx, svc, quarantineVar, reason, c, audit.TriggerGC)
+}
+
+// collectService cleans up a single service that is managed by this
+// Signalilo. In a dry run, the service is only reported, but not deleted.
+// A panic while collecting the service is recovered and reported as error,
+// so a single service can't stop garbage collection.
+func collectService(ctx context.Context, ts time.Time, svc icinga2.Service, c config.Configuration, downtimed map[string]bool, dryRun bool) (report ServiceReport) {
+	l := c.GetLogger().WithField(logging.FieldOperation, "gc").WithField(logging.FieldService, svc.Name)
+	icinga := c.GetIcingaClient()
+
+	defer func() {
+		if r := recover(); r != nil {
+			l.Errorf("[Collect] Recovered from panic while collecting service %v: %v", svc.Name, r)
+			report.Name = svc.Name
+			report.Decision = DecisionKeep
+			report.Error = fmt.Sprintf("panic: %v", r)
 		}
+	}()
+
+	report = decide(ts, svc, downtimed, c.GetConfig().MaxAge)
+	if report.Malformed {
+		l.Errorf("[Collect] Skipping malformed service %v: %v", svc.Name, report.Reason)
+		if c.GetConfig().GCQuarantine && !report.Quarantined && !dryRun {
+			if err := quarantine(ctx, svc, report.Reason, c); err != nil {
+				l.Errorf("[Collect] Unable to quarantine service %v: %v", svc.Name, err)
+				report.Error = err.Error()
+			} else {
+				report.Quarantined = true
+			}
+		}
+		return report
+	}
+	if report.Decision != DecisionDelete {
+		l.V(2).Infof("[Collect] Skipping service %v: %v", svc.Name, report.Reason)
+		return report
+	}
+	if dryRun {
+		l.V(2).Infof("[Collect] Would delete service %v: %v", svc.Name, report.Reason)
+		return report
+	}
+	l.V(2).Infof("[Collect] Deleting service %v: %v", svc.Name, report.Reason)
+	start := time.Now()
+	_, span := tracing.StartIcingaCall(ctx, "delete_service", icinga.GetClientConfig().URL, tracing.AttrService.String(svc.Name))
+	err := deleteService(ctx, svc, c, audit.TriggerGC, report.Reason)
+	tracing.End(span, err)
+	l = logging.WithCall(l, "delete_service", icinga.GetClientConfig().URL, start)
+	if err != nil {
+		l.Errorf("[Collect] Error while deleting service %v: %v", svc.Name, err)
+		report.Error = err.Error()
 	} else {
-		l.V(2).Infof("[Collect] Skipping service %v: keep_for = %v; age = %v", svc.Name, keepFor, serviceAge)
+		l.V(2).Infof("[Collect] Deleted service %v", svc.Name)
 	}
-	return nil
+	return report
 }
 
-// Collect runs a garbage collection cycle to clean up any old
-// Signalilo-managed service objects
-func Collect(ts time.Time, c config.Configuration) error {
-	l := c.GetLogger()
-	l.Infof("[Collect] Running garbage collection at ts=%v", ts)
+// Run runs a garbage collection cycle to clean up any old Signalilo-managed
+// service objects, and reports the decision taken for each service. In a
+// dry run, no services are deleted.
+func Run(ctx context.Context, ts time.Time, c config.Configuration, dryRun bool) (report Report, err error) {
+	ctx, span := tracing.Start(ctx, "gc", attribute.Bool("signalilo.gc.dry_run", dryRun))
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("signalilo.gc.deleted", report.Deleted),
+			attribute.Int("signalilo.gc.kept", report.Kept),
+			attribute.Int("signalilo.gc.errors", report.Errors),
+		)
+		tracing.End(span, err)
+	}()
+	l := c.GetLogger().WithField(logging.FieldOperation, "gc")
+	l.Infof("[Collect] Running garbage collection at ts=%v, dry run=%v", ts, dryRun)
 	// Get all signalilo services
 	icinga := c.GetIcingaClient()
 	hostname := c.GetConfig().HostName
-	services, err := icinga.ListServices(icinga2.QueryFilter{
-		Filter: fmt.Sprintf(`match("%v", service.host_name)`, hostname),
-	})
+	report = Report{
+		Timestamp: ts,
+		DryRun:    dryRun,
+		Host:      hostname,
+		Services:  []ServiceReport{},
+	}
+	uuid := c.GetConfig().UUID
+	if previous := c.GetConfig().PreviousUUIDs; len(previous) > 0 && !dryRun {
+		// Take over the services of previous UUIDs, so they're collected
+		// below
+		adopted, err := Adopt(ctx, ts, c, previous, AdoptTakeOver, false)
+		if err != nil {
+			l.Errorf("[Collect] Error while adopting services of previous UUIDs: %v", err)
+		}
+		report.Adopted = adopted.Adopted
+	}
+	managed, err := listManagedServices(ctx, icinga, hostname, uuid)
 	if err != nil {
-		l.Errorf(fmt.Sprintf("[Collect] Error while listing services: %v", err))
-		return err
+		l.Errorf("[Collect] Error while listing services: %v", err)
+		return report, err
 	}
-	l.V(2).Infof("[Collect] Found %v services with host = %v", len(services), hostname)
+	l.V(2).Infof("[Collect] Found %v services with host = %v", len(managed), hostname)
+	_, dtSpan := tracing.StartIcingaCall(ctx, "list_downtimes", icinga.GetClientConfig().URL)
 	downtimes, err := icinga.ListDowntimes(icinga2.QueryFilter{
-		Filter: fmt.Sprintf(`match("%v", downtime.host_name)`, hostname),
+		Filter: fmt.Sprintf(`downtime.host_name == %q`, hostname),
 	})
+	tracing.End(dtSpan, err)
 	if err != nil {
-		l.Errorf(fmt.Sprintf("[Collect] Error while listing downtimes: %v", err))
-		return err
+		l.Errorf("[Collect] Error while listing downtimes: %v", err)
+		return report, err
 	}
 	l.V(2).Infof("[Collect] Found %v downtimes with host = %v", len(downtimes), hostname)
-	// Iterate through services, finding ones that are managed by this
-	// Signalilo and delete services which have transitioned to OK longer
-	// than keep_for ago
-	for _, svc := range services {
-		if svc.Vars["bridge_uuid"] == c.GetConfig().UUID {
-			l.Infof("[Collect] Found service %v with our bridge UUID", svc.Name)
-			err = collectService(svc, c, downtimes)
-			if err != nil {
-				l.Errorf(fmt.Sprintf("[Collect] Error garbage-collecting service: %v", err))
-			}
+	downtimed := indexDowntimes(downtimes)
+
+	// Delete services which are managed by this Signalilo and have
+	// transitioned to OK longer than keep_for ago, or which haven't been
+	// updated for max age. Services are collected concurrently, but
+	// reported in the order in which they were listed.
+	concurrency := c.GetConfig().GCConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	reports := make([]ServiceReport, len(managed))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, svc := range managed {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, svc icinga2.Service) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			l.WithField(logging.FieldService, svc.Name).V(2).Infof("[Collect] Found service %v with our bridge UUID", svc.Name)
+			reports[i] = collectService(ctx, ts, svc, c, downtimed, dryRun)
+		}(i, svc)
+	}
+	wg.Wait()
+
+	for _, svcReport := range reports {
+		report.Services = append(report.Services, svcReport)
+		if svcReport.Malformed {
+			report.Malformed++
+		}
+		switch {
+		case svcReport.Error != "":
+			report.Errors++
+		case svcReport.Decision == DecisionDelete:
+			report.Deleted++
+		default:
+			report.Kept++
 		}
 	}
-	l.Infof("[Collect] Garbage collection completed in %v", time.Since(ts))
-	return nil
+	report.Duration = time.Since(ts).String()
+	l.WithField(logging.FieldDuration, time.Since(ts).Seconds()).Infof("[Collect] Garbage collection completed in %v: %v deleted, %v kept, %v errors, %v malformed",
+		report.Duration, report.Deleted, report.Kept, report.Errors, report.Malformed)
+	return report, nil
+}
+
+// Collect runs a garbage collection cycle to clean up any old
+// Signalilo-managed service objects
+func Collect(ctx context.Context, ts time.Time, c config.Configuration) error {
+	_, err := Run(ctx, ts, c, false)
+	return err
 }
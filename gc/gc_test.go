@@ -0,0 +1,475 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/logging"
+)
+
+const testUUID = "4ae3b2ff-9b3a-4b1c-8a2e-d6a6e2a4d1f0"
+
+// managedService creates a service managed by the Signalilo with testUUID,
+// whose state last changed age before ts
+func managedService(name string, state float64, ts time.Time, age time.Duration, vars icinga2.Vars) icinga2.Service {
+	svcVars := icinga2.Vars{
+		"bridge_uuid": testUUID,
+		"keep_for":    float64(time.Hour),
+	}
+	for k, v := range vars {
+		svcVars[k] = v
+	}
+	return icinga2.Service{
+		Name:            name,
+		HostName:        "signalilo_test",
+		State:           state,
+		LastStateChange: float64(ts.Add(-age).UnixNano()) / 1e9,
+		Vars:            svcVars,
+	}
+}
+
+// fakeIcinga is a mock Icinga backend which supports downtimes and can be
+// made to panic when deleting a service
+type fakeIcinga struct {
+	*icinga2.MockClient
+	downtimes   []icinga2.Downtime
+	panicOnName string
+
+	mutex       sync.Mutex
+	deleting    int
+	maxDeleting int
+	listQuery   icinga2.QueryFilter
+}
+
+func (f *fakeIcinga) ListServices(query icinga2.QueryFilter) ([]icinga2.Service, error) {
+	f.listQuery = query
+	return f.MockClient.ListServices(query)
+}
+
+func (f *fakeIcinga) ListDowntimes(query icinga2.QueryFilter) ([]icinga2.Downtime, error) {
+	return f.downtimes, nil
+}
+
+func (f *fakeIcinga) DeleteService(name string) error {
+	if f.panicOnName != "" && name == "signalilo_test!"+f.panicOnName {
+		panic("unexpected response")
+	}
+	f.mutex.Lock()
+	f.deleting++
+	if f.deleting > f.maxDeleting {
+		f.maxDeleting = f.deleting
+	}
+	f.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	defer func() {
+		f.mutex.Lock()
+		f.deleting--
+		f.mutex.Unlock()
+	}()
+	return f.MockClient.DeleteService(name)
+}
+
+func newTestConfiguration(services ...icinga2.Service) (config.Configuration, *fakeIcinga) {
+	c := config.NewMockConfiguration(0)
+	c.GetConfig().UUID = testUUID
+	c.GetConfig().HostName = "signalilo_test"
+	icinga := &fakeIcinga{MockClient: icinga2.NewMockClient()}
+	for _, svc := range services {
+		_ = icinga.CreateService(svc)
+	}
+	c.SetIcingaClient(icinga)
+	return c, icinga
+}
+
+func TestDecide(t *testing.T) {
+	ts := time.Now()
+	downtimes := indexDowntimes([]icinga2.Downtime{{Service: "downtimed_heartbeat"}, {Service: "downtimed_firing"}})
+	cases := map[string]struct {
+		svc      icinga2.Service
+		decision Decision
+	}{
+		"old OK service": {
+			managedService("old", 0, ts, 2*time.Hour, nil),
+			DecisionDelete,
+		},
+		"recent OK service": {
+			managedService("recent", 0, ts, 30*time.Minute, nil),
+			DecisionKeep,
+		},
+		"old firing service": {
+			managedService("firing", 2, ts, 2*time.Hour, nil),
+			DecisionKeep,
+		},
+		"heartbeat": {
+			managedService("heartbeat", 0, ts, 2*time.Hour, icinga2.Vars{"label_heartbeat": "60s"}),
+			DecisionKeep,
+		},
+		"downtimed heartbeat": {
+			managedService("downtimed_heartbeat", 2, ts, 2*time.Hour, icinga2.Vars{"label_heartbeat": "60s"}),
+			DecisionDelete,
+		},
+		"downtimed firing service": {
+			managedService("downtimed_firing", 2, ts, 2*time.Hour, nil),
+			DecisionKeep,
+		},
+		"recent downtimed heartbeat": {
+			managedService("downtimed_heartbeat", 0, ts, 30*time.Minute, icinga2.Vars{"label_heartbeat": "60s"}),
+			DecisionKeep,
+		},
+		"firing heartbeat": {
+			managedService("heartbeat", 2, ts, 2*time.Hour, icinga2.Vars{"label_heartbeat": "60s"}),
+			DecisionKeep,
+		},
+		"missing keep_for": {
+			managedService("missing", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": nil}),
+			DecisionKeep,
+		},
+		"keep_for as duration string": {
+			managedService("string", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": "1h"}),
+			DecisionDelete,
+		},
+		"keep_for as time.Duration": {
+			managedService("duration", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": 3 * time.Hour}),
+			DecisionKeep,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			report := decide(ts, tc.svc, downtimes, 0)
+			assert.Equal(t, tc.decision, report.Decision, report.Reason)
+			assert.NotEmpty(t, report.Reason)
+		})
+	}
+}
+
+func TestDecideMaxAge(t *testing.T) {
+	ts := time.Now().Truncate(time.Second)
+	maxAge := 24 * time.Hour
+	updated := func(age time.Duration) icinga2.Vars {
+		return icinga2.Vars{"signalilo_last_update": float64(ts.Add(-age).Unix())}
+	}
+
+	stale := managedService("stale", 2, ts, 48*time.Hour, updated(25*time.Hour))
+	report := decide(ts, stale, nil, maxAge)
+	assert.Equal(t, DecisionDelete, report.Decision, report.Reason)
+	assert.Equal(t, "25h0m0s", report.SinceUpdate)
+
+	report = decide(ts, stale, nil, 0)
+	assert.Equal(t, DecisionKeep, report.Decision, "max age disabled")
+
+	repeated := managedService("repeated", 2, ts, 48*time.Hour, updated(4*time.Hour))
+	report = decide(ts, repeated, nil, maxAge)
+	assert.Equal(t, DecisionKeep, report.Decision, "firing alert which is still being updated")
+
+	legacy := managedService("legacy", 2, ts, 48*time.Hour, nil)
+	report = decide(ts, legacy, nil, maxAge)
+	assert.Equal(t, DecisionKeep, report.Decision, "last update unknown")
+
+	heartbeat := managedService("heartbeat", 2, ts, 48*time.Hour, updated(25*time.Hour))
+	heartbeat.Vars["label_heartbeat"] = "60s"
+	report = decide(ts, heartbeat, nil, maxAge)
+	assert.Equal(t, DecisionKeep, report.Decision, "missed heartbeats aren't stale")
+
+	customKeepFor := managedService("custom", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": float64(3 * time.Hour)})
+	report = decide(ts, customKeepFor, nil, maxAge)
+	assert.Equal(t, DecisionKeep, report.Decision, "per-service keep_for is honoured")
+	assert.Equal(t, "3h0m0s", report.KeepFor)
+}
+
+func TestRunDryRun(t *testing.T) {
+	ts := time.Now()
+	foreign := managedService("foreign", 0, ts, 2*time.Hour, icinga2.Vars{"bridge_uuid": "other"})
+	c, icinga := newTestConfiguration(
+		managedService("old", 0, ts, 2*time.Hour, nil),
+		managedService("recent", 0, ts, time.Minute, nil),
+		foreign,
+	)
+
+	report, err := Run(context.Background(), ts, c, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.Services, 2, "only services with our bridge UUID are reported")
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, 1, report.Kept)
+	assert.Len(t, icinga.Services, 3, "dry run doesn't delete services")
+
+	report, err = Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Len(t, icinga.Services, 2)
+	assert.NotContains(t, icinga.Services, "signalilo_test!old")
+	assert.Contains(t, icinga.Services, foreign.FullName())
+}
+
+func TestParseKeepFor(t *testing.T) {
+	valid := map[string]struct {
+		value   interface{}
+		keepFor time.Duration
+	}{
+		"nanoseconds from JSON": {float64(time.Hour), time.Hour},
+		"int":                   {int(time.Hour), time.Hour},
+		"time.Duration":         {time.Hour, time.Hour},
+		"duration string":       {"24h", 24 * time.Hour},
+		"numeric string":        {"3600000000000", time.Hour},
+	}
+	for name, tc := range valid {
+		keepFor, err := parseKeepFor(tc.value)
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.keepFor, keepFor, name)
+	}
+
+	invalid := map[string]interface{}{
+		"missing":     nil,
+		"garbage":     "forever",
+		"negative":    float64(-time.Hour),
+		"wrong type":  true,
+		"nested type": map[string]interface{}{"hours": 1},
+	}
+	for name, value := range invalid {
+		_, err := parseKeepFor(value)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestRunMalformed(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		managedService("old", 0, ts, 2*time.Hour, nil),
+		managedService("missing", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": nil}),
+		managedService("garbage", 0, ts, 2*time.Hour, icinga2.Vars{"keep_for": "forever"}),
+		managedService("update", 2, ts, 2*time.Hour, icinga2.Vars{"signalilo_last_update": true}),
+	)
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Malformed)
+	assert.Equal(t, 1, report.Deleted, "malformed services don't stop garbage collection")
+	assert.Len(t, icinga.Services, 3)
+	for _, svc := range icinga.Services {
+		assert.NotContains(t, svc.Vars, quarantineVar, "quarantine disabled by default")
+	}
+
+	c.GetConfig().GCQuarantine = true
+	report, err = Run(context.Background(), ts, c, true)
+	assert.NoError(t, err)
+	for _, svc := range icinga.Services {
+		assert.NotContains(t, svc.Vars, quarantineVar, "dry run doesn't quarantine")
+	}
+
+	report, err = Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Malformed)
+	for _, svc := range icinga.Services {
+		assert.Contains(t, svc.Vars, quarantineVar)
+	}
+	assert.Equal(t, "malformed: keep_for missing", icinga.Services["signalilo_test!missing"].Vars[quarantineVar])
+	for _, svcReport := range report.Services {
+		assert.True(t, svcReport.Quarantined, svcReport.Name)
+	}
+}
+
+func TestRunRecoversFromPanic(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		managedService("a", 0, ts, 2*time.Hour, nil),
+		managedService("b", 0, ts, 2*time.Hour, nil),
+		managedService("c", 0, ts, 2*time.Hour, nil),
+	)
+	icinga.panicOnName = "b"
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Errors)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, []string{"signalilo_test!b"}, serviceNames(icinga))
+	for _, svcReport := range report.Services {
+		if svcReport.Name == "b" {
+			assert.Equal(t, "panic: unexpected response", svcReport.Error)
+			assert.Equal(t, DecisionKeep, svcReport.Decision)
+		}
+	}
+}
+
+func TestRunDowntimedHeartbeat(t *testing.T) {
+	ts := time.Now()
+	hb := icinga2.Vars{"label_heartbeat": "60s"}
+	c, icinga := newTestConfiguration(
+		managedService("heartbeat", 2, ts, 2*time.Hour, hb),
+		managedService("retired_heartbeat", 2, ts, 2*time.Hour, hb),
+	)
+	icinga.downtimes = []icinga2.Downtime{{Service: "retired_heartbeat"}}
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, []string{"signalilo_test!heartbeat"}, serviceNames(icinga))
+}
+
+func serviceNames(icinga *fakeIcinga) []string {
+	names := []string{}
+	for name := range icinga.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestServiceFilter(t *testing.T) {
+	assert.Equal(t, `service.host_name == "signalilo_test" && service.vars.bridge_uuid == "uuid"`,
+		serviceFilter("signalilo_test", "uuid"))
+	assert.Equal(t, `service.host_name == "a\" || true || \"" && service.vars.bridge_uuid == "uuid"`,
+		serviceFilter(`a" || true || "`, "uuid"), "host name is quoted")
+}
+
+func TestListManagedServices(t *testing.T) {
+	ts := time.Now()
+	_, icinga := newTestConfiguration(
+		managedService("ours", 0, ts, time.Minute, nil),
+		managedService("other", 0, ts, time.Minute, icinga2.Vars{"bridge_uuid": "other"}),
+	)
+	services, err := listManagedServices(context.Background(), icinga, "signalilo_test", testUUID)
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1, "services of clients which don't filter are filtered by bridge UUID") {
+		assert.Equal(t, "ours", services[0].Name)
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	ts := time.Now()
+	var services []icinga2.Service
+	for i := 0; i < 50; i++ {
+		services = append(services, managedService(fmt.Sprintf("svc%02d", i), 0, ts, 2*time.Hour, nil))
+	}
+	c, icinga := newTestConfiguration(services...)
+	c.GetConfig().GCConcurrency = 4
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, report.Deleted)
+	assert.Empty(t, icinga.Services)
+	assert.LessOrEqual(t, icinga.maxDeleting, 4)
+	assert.Greater(t, icinga.maxDeleting, 1, "services are deleted concurrently")
+	assert.Equal(t, serviceFilter("signalilo_test", testUUID), icinga.listQuery.Filter)
+}
+
+// icingaAPI is a minimal Icinga API which, like Icinga, rejects updates of
+// attributes that can't be modified
+type icingaAPI struct {
+	mutex    sync.Mutex
+	services map[string]icinga2.Service
+}
+
+// newIcingaAPI starts an icingaAPI with the given services and returns an
+// endpoint manager connected to it
+func newIcingaAPI(t *testing.T, services ...icinga2.Service) (*icingaAPI, icinga2.Client) {
+	api := &icingaAPI{services: map[string]icinga2.Service{}}
+	for _, svc := range services {
+		api.services[svc.FullName()] = svc
+	}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	factory := func(u string) (icinga2.Client, error) {
+		return icinga2.New(icinga2.WebClient{URL: u})
+	}
+	m, err := endpoint.New([]string{server.URL}, factory, endpoint.Options{HealthCheckInterval: time.Second}, logging.NewDiscard(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, m
+}
+
+func (a *icingaAPI) service(name string) icinga2.Service {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.services[name]
+}
+
+func (a *icingaAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.TrimPrefix(r.URL.Path, "/v1/objects/")
+	name := strings.TrimPrefix(path, "services/")
+	// Icinga returns the variables as object, which the flattening
+	// icinga2.Service.MarshalJSON doesn't
+	type attrs icinga2.Service
+	results := []map[string]attrs{}
+	for _, svc := range a.services {
+		if path == "services" || svc.FullName() == name {
+			results = append(results, map[string]attrs{"attrs": attrs(svc)})
+		}
+	}
+	switch {
+	case path == "downtimes":
+		fmt.Fprint(w, `{"results":[]}`)
+	case r.Method == http.MethodGet && len(results) > 0:
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case r.Method == http.MethodPost:
+		svc, ok := a.services[name]
+		update := struct {
+			Attrs map[string]interface{} `json:"attrs"`
+		}{}
+		if !ok || json.NewDecoder(r.Body).Decode(&update) != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		vars := icinga2.Vars{}
+		for k, v := range svc.Vars {
+			vars[k] = v
+		}
+		for attr, value := range update.Attrs {
+			if !strings.HasPrefix(attr, "vars.") {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `{"results":[{"code":500,"errors":["Attribute cannot be modified."],"status":"Attribute '%v' could not be set."}]}`, attr)
+				return
+			}
+			vars[strings.TrimPrefix(attr, "vars.")] = value
+		}
+		svc.Vars = vars
+		a.services[name] = svc
+		fmt.Fprint(w, `{"results":[{"code":200,"status":"Attributes updated."}]}`)
+	case r.Method == http.MethodDelete:
+		delete(a.services, name)
+		fmt.Fprint(w, `{"results":[{"code":200,"status":"Object was deleted."}]}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRunQuarantineIcingaAPI(t *testing.T) {
+	ts := time.Now()
+	c, _ := newTestConfiguration()
+	api, icinga := newIcingaAPI(t, managedService("missing", 2, ts, 2*time.Hour, icinga2.Vars{"keep_for": nil}))
+	c.SetIcingaClient(icinga)
+	c.GetConfig().GCQuarantine = true
+
+	report, err := Run(context.Background(), ts, c, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Malformed)
+	assert.Equal(t, 0, report.Errors)
+	svc := api.service("signalilo_test!missing")
+	assert.Equal(t, "malformed: keep_for missing", svc.Vars[quarantineVar], "only variables are updated on services which aren't OK")
+	assert.Equal(t, testUUID, svc.Vars["bridge_uuid"])
+	assert.Equal(t, float64(2), svc.State)
+}
@@ -0,0 +1,182 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/tracing"
+	"github.com/vshn/signalilo/webhook"
+)
+
+// ErrNotFound is returned if a service doesn't exist or isn't managed by
+// this Signalilo
+var ErrNotFound = errors.New("service not found")
+
+// ManagedService describes a service which is managed by this Signalilo
+type ManagedService struct {
+	Name            string            `json:"name"`
+	DisplayName     string            `json:"display_name,omitempty"`
+	State           int               `json:"state"`
+	LastStateChange *time.Time        `json:"last_state_change,omitempty"`
+	LastUpdate      *time.Time        `json:"last_update,omitempty"`
+	KeepFor         string            `json:"keep_for,omitempty"`
+	Labels          map[string]string `json:"labels"`
+	Quarantined     bool              `json:"quarantined,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// describe returns the description of svc. Malformed variables are
+// reported in the description's error.
+func describe(svc icinga2.Service) ManagedService {
+	managed := ManagedService{
+		Name:        svc.Name,
+		DisplayName: svc.DisplayName,
+		State:       int(svc.State),
+		Labels:      map[string]string{},
+	}
+	if svc.LastStateChange > 0 {
+		ts := time.Unix(int64(svc.LastStateChange), 0)
+		managed.LastStateChange = &ts
+	}
+	var problems []string
+	if ts, ok, err := lastUpdate(svc); err != nil {
+		problems = append(problems, err.Error())
+	} else if ok {
+		managed.LastUpdate = &ts
+	}
+	if keepFor, err := parseKeepFor(svc.Vars["keep_for"]); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		managed.KeepFor = keepFor.String()
+	}
+	managed.Error = strings.Join(problems, "; ")
+	_, managed.Quarantined = svc.Vars[quarantineVar]
+	for k, v := range svc.Vars {
+		if strings.HasPrefix(k, "label_") {
+			managed.Labels[strings.TrimPrefix(k, "label_")] = fmt.Sprint(v)
+		}
+	}
+	return managed
+}
+
+// listManaged lists the services which are managed by this Signalilo,
+// sorted by name
+func listManaged(ctx context.Context, c config.Configuration) ([]icinga2.Service, error) {
+	managed, err := listManagedServices(ctx, c.GetIcingaClient(), c.GetConfig().HostName, c.GetConfig().UUID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(managed, func(i, j int) bool { return managed[i].Name < managed[j].Name })
+	return managed, nil
+}
+
+// findManaged returns the service called name, if it's managed by this
+// Signalilo
+func findManaged(ctx context.Context, c config.Configuration, name string) (svc icinga2.Service, err error) {
+	// Names which Signalilo doesn't create can't be managed, and mustn't
+	// end up in the Icinga API URL
+	if !webhook.ValidateServiceName(name) {
+		return icinga2.Service{}, ErrNotFound
+	}
+	icinga := c.GetIcingaClient()
+	_, span := tracing.StartIcingaCall(ctx, "get_service", icinga.GetClientConfig().URL, tracing.AttrService.String(name))
+	defer func() { tracing.End(span, err) }()
+	svc, err = icinga.GetService(fmt.Sprintf("%v!%v", c.GetConfig().HostName, name))
+	if endpoint.IsEndpointError(err) {
+		return icinga2.Service{}, err
+	}
+	// The Icinga client doesn't tell missing services apart from other
+	// errors of the Icinga API
+	if err != nil || svc.Vars["bridge_uuid"] != c.GetConfig().UUID {
+		return icinga2.Service{}, ErrNotFound
+	}
+	return svc, nil
+}
+
+// ListServices describes the services which are managed by this Signalilo
+func ListServices(ctx context.Context, c config.Configuration) ([]ManagedService, error) {
+	services, err := listManaged(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	described := make([]ManagedService, 0, len(services))
+	for _, svc := range services {
+		described = append(described, describe(svc))
+	}
+	return described, nil
+}
+
+// GetService describes the service called name. ErrNotFound is returned if
+// the service isn't managed by this Signalilo.
+func GetService(ctx context.Context, c config.Configuration, name string) (ManagedService, error) {
+	svc, err := findManaged(ctx, c, name)
+	if err != nil {
+		return ManagedService{}, err
+	}
+	return describe(svc), nil
+}
+
+// ResolveService submits an OK check result with the given plugin output
+// for the service called name, so it's garbage collected once its keep_for
+// has expired. ErrNotFound is returned if the service isn't managed by this
+// Signalilo.
+func ResolveService(ctx context.Context, ts time.Time, c config.Configuration, name, output string) error {
+	svc, err := findManaged(ctx, c, name)
+	if err != nil {
+		return err
+	}
+	icinga := c.GetIcingaClient()
+	action := icinga2.Action{
+		ExitStatus:     0,
+		PluginOutput:   output,
+		CheckSource:    c.GetConfig().CheckSource,
+		ExecutionStart: webhook.IcingaTimestamp(ts),
+		ExecutionEnd:   webhook.IcingaTimestamp(ts),
+	}
+	_, span := tracing.StartIcingaCall(ctx, "process_check_result", icinga.GetClientConfig().URL, tracing.AttrService.String(svc.Name))
+	err = icinga.ProcessCheckResult(svc, action)
+	tracing.End(span, err)
+	// The next alert for the service must be submitted, even if it's the
+	// same as the last one submitted through the webhook
+	webhook.ForgetCheckResult(svc.FullName())
+	exitStatus := action.ExitStatus
+	recordAudit(ctx, c, audit.Event{
+		Action:       audit.ActionCheckResult,
+		Trigger:      audit.TriggerAdmin,
+		Service:      svc.FullName(),
+		ExitStatus:   &exitStatus,
+		PluginOutput: output,
+		Error:        audit.ErrorMessage(err),
+	})
+	return err
+}
+
+// DeleteService deletes the service called name. ErrNotFound is returned if
+// the service isn't managed by this Signalilo.
+func DeleteService(ctx context.Context, c config.Configuration, name string) error {
+	svc, err := findManaged(ctx, c, name)
+	if err != nil {
+		return err
+	}
+	_, span := tracing.StartIcingaCall(ctx, "delete_service", c.GetIcingaClient().GetClientConfig().URL, tracing.AttrService.String(svc.Name))
+	err = deleteService(ctx, svc, c, audit.TriggerAdmin, "deleted through admin API")
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,37 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package gc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+func TestFindManaged(t *testing.T) {
+	ts := time.Now()
+	c, icinga := newTestConfiguration(
+		managedService("ours", 2, ts, time.Minute, nil),
+		managedService("other", 2, ts, time.Minute, icinga2.Vars{"bridge_uuid": "other"}),
+	)
+
+	svc, err := findManaged(context.Background(), c, "ours")
+	assert.NoError(t, err)
+	assert.Equal(t, "ours", svc.Name)
+	assert.Equal(t, icinga2.QueryFilter{}, icinga.listQuery, "services are looked up by name instead of listed")
+
+	for _, name := range []string{"other", "missing", "../ours", "signalilo_test!ours"} {
+		_, err := findManaged(context.Background(), c, name)
+		assert.ErrorIs(t, err, ErrNotFound, name)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/bketelsen/logr"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/gc"
+	"github.com/vshn/signalilo/stats"
+)
+
+// GCCommand runs a single garbage collection cycle and prints the report
+type GCCommand struct {
+	logLevel     int
+	dryRun       bool
+	config       config.SignaliloConfig
+	logger       logr.Logger
+	icingaClient icinga2.Client
+	stats        *stats.Stats
+	auditLog     *audit.Log
+}
+
+// GetConfig implements config.Configuration
+func (g *GCCommand) GetConfig() *config.SignaliloConfig {
+	return &g.config
+}
+
+// GetLogger implements config.Configuration
+func (g *GCCommand) GetLogger() logr.Logger {
+	return g.logger
+}
+
+// GetIcingaClient implements config.Configuration
+func (g *GCCommand) GetIcingaClient() icinga2.Client {
+	return g.icingaClient
+}
+
+// GetStats implements config.Configuration
+func (g *GCCommand) GetStats() *stats.Stats {
+	return g.stats
+}
+
+// GetAuditLog implements config.Configuration
+func (g *GCCommand) GetAuditLog() *audit.Log {
+	return g.auditLog
+}
+
+// SetAuditLog implements config.Configuration
+func (g *GCCommand) SetAuditLog(log *audit.Log) {
+	g.auditLog = log
+}
+
+// SetLogger implements config.Configuration
+func (g *GCCommand) SetLogger(logger logr.Logger) {
+	g.logger = logger
+}
+
+// SetIcingaClient implements config.Configuration
+func (g *GCCommand) SetIcingaClient(client icinga2.Client) {
+	g.icingaClient = client
+}
+
+func (g *GCCommand) initialize(ctx *kingpin.ParseContext) error {
+	if err := checkReportAuditLog("gc", g.config); err != nil {
+		return err
+	}
+	g.logger = config.NewLogger(g.logLevel, g.config.LogFormat, g.config.LogOutput)
+	return config.ConfigInitialize(g)
+}
+
+// checkReportAuditLog rejects writing the audit log to stdout for commands
+// which print their report to stdout
+func checkReportAuditLog(command string, c config.SignaliloConfig) error {
+	if c.AuditLogPath == "-" {
+		return fmt.Errorf("the %v command prints its report to stdout, use a file as --audit_log", command)
+	}
+	return nil
+}
+
+func (g *GCCommand) run(pc *kingpin.ParseContext) error {
+	if g.GetIcingaClient() == nil {
+		return fmt.Errorf("unable to create Icinga API client, see log for details")
+	}
+	defer g.GetAuditLog().Close()
+	report, err := gc.Run(context.Background(), time.Now(), g, g.dryRun)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func configureGCCommand(app *kingpin.Application) {
+	// The report is printed to stdout, so logs go to stderr
+	g := &GCCommand{logLevel: 1, stats: stats.New(), config: config.SignaliloConfig{LogOutput: config.LogOutputStderr}}
+	cmd := app.Command("gc", "Run a single garbage collection cycle and print a JSON report of the decision for each service").Action(g.run).PreAction(g.initialize)
+	configureIcingaFlags(cmd, &g.config)
+	configureGCFlags(cmd, &g.config)
+	cmd.Flag("dry-run", "Only report which services would be deleted, without deleting them").BoolVar(&g.dryRun)
+}
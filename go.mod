@@ -6,8 +6,15 @@ require (
 	github.com/alecthomas/kingpin/v2 v2.3.2
 	github.com/bketelsen/logr v0.0.0-20170116012416-f3d070bdd1c5
 	github.com/corvus-ch/logr v0.0.0-20210413064445-af2a51d190ad
+	github.com/itchyny/gojq v0.12.11
 	github.com/prometheus/alertmanager v0.25.0
+	github.com/prometheus/common v0.38.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.8.4
 	github.com/vshn/go-icinga2-client v0.0.17
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+	gopkg.in/yaml.v3 v3.0.1
 )
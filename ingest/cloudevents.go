@@ -0,0 +1,234 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package ingest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+)
+
+// CloudEvents content types of the structured and batched HTTP modes
+const (
+	cloudEventsJSON  = "application/cloudevents+json"
+	cloudEventsBatch = "application/cloudevents-batch+json"
+)
+
+// cloudEventsReceiver is the receiver of alerts mapped from CloudEvents
+const cloudEventsReceiver = "cloudevents"
+
+// headerPrefix prefixes the attributes of binary mode CloudEvents
+const headerPrefix = "Ce-"
+
+// Rule maps the CloudEvents it matches to alerts. The expressions are
+// evaluated against the event in its JSON format, with the data in the
+// data attribute.
+type Rule struct {
+	// Match selects the events the rule applies to. Defaults to all events.
+	Match  string `yaml:"match"`
+	Source `yaml:",inline"`
+
+	match *gojq.Code
+}
+
+// compile compiles the expressions of the rule
+func (r *Rule) compile() error {
+	if r.Events != "" {
+		return fmt.Errorf("events isn't supported in cloudevents rules")
+	}
+	if r.Match != "" {
+		query, err := gojq.Parse(r.Match)
+		if err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+		if r.match, err = gojq.Compile(query); err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+	}
+	return r.Source.compile(cloudEventsReceiver)
+}
+
+// matches returns true if the rule applies to event
+func (r *Rule) matches(event map[string]interface{}) (bool, error) {
+	if r.match == nil {
+		return true, nil
+	}
+	v, err := evalFirst(r.match, event)
+	if err != nil {
+		return false, fmt.Errorf("match: %w", err)
+	}
+	return v != nil && v != false, nil
+}
+
+// DecodeCloudEvents maps the CloudEvents of a request in structured, batched
+// or binary HTTP mode to alerts. Each event is mapped by the first rule
+// which matches it. Events which no rule matches are ignored. Labels
+// alertname, source and subject default to the attributes type, source and
+// subject of the event.
+func (c *Config) DecodeCloudEvents(header http.Header, body io.Reader) (template.Data, error) {
+	events, err := parseCloudEvents(header, body)
+	if err != nil {
+		return template.Data{}, err
+	}
+	data := template.Data{
+		Receiver: cloudEventsReceiver,
+		Status:   string(model.AlertResolved),
+		Alerts:   template.Alerts{},
+	}
+	for _, event := range events {
+		if err := validateCloudEvent(event); err != nil {
+			return template.Data{}, err
+		}
+		for i, rule := range c.CloudEvents {
+			ok, err := rule.matches(event)
+			if err != nil {
+				return template.Data{}, fmt.Errorf("cloudevents rule %v: %w", i, err)
+			}
+			if !ok {
+				continue
+			}
+			alert, err := rule.alert(event, template.KV{
+				"alertname": attribute(event, "type"),
+				"source":    attribute(event, "source"),
+				"subject":   attribute(event, "subject"),
+			})
+			if err != nil {
+				return template.Data{}, fmt.Errorf("cloudevents rule %v: %w", i, err)
+			}
+			if alert.Status == string(model.AlertFiring) {
+				data.Status = string(model.AlertFiring)
+			}
+			data.Alerts = append(data.Alerts, alert)
+			break
+		}
+	}
+	return data, nil
+}
+
+// parseCloudEvents returns the events of a request in their JSON format
+func parseCloudEvents(header http.Header, body io.Reader) ([]map[string]interface{}, error) {
+	contentType := header.Get("Content-Type")
+	mediaType := ""
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("invalid content type: %w", err)
+		}
+	}
+	switch mediaType {
+	case cloudEventsJSON:
+		event := map[string]interface{}{}
+		if err := json.NewDecoder(body).Decode(&event); err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{event}, decodeBase64Data(event)
+	case cloudEventsBatch:
+		events := []map[string]interface{}{}
+		if err := json.NewDecoder(body).Decode(&events); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if err := decodeBase64Data(event); err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	}
+
+	// Binary mode, the attributes are sent as headers and the body is the
+	// event data
+	event := map[string]interface{}{}
+	for name, values := range header {
+		if strings.HasPrefix(name, headerPrefix) && len(values) > 0 {
+			event[strings.ToLower(strings.TrimPrefix(name, headerPrefix))] = values[0]
+		}
+	}
+	if event["specversion"] == nil {
+		return nil, fmt.Errorf("request is neither a structured nor a binary mode CloudEvent")
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		event["datacontenttype"] = contentType
+	}
+	if len(content) > 0 {
+		if isJSON(mediaType) {
+			var data interface{}
+			if err := json.Unmarshal(content, &data); err != nil {
+				return nil, fmt.Errorf("invalid event data: %w", err)
+			}
+			event["data"] = data
+		} else {
+			event["data"] = string(content)
+		}
+	}
+	return []map[string]interface{}{event}, nil
+}
+
+// decodeBase64Data decodes the data_base64 attribute of a structured mode
+// event into data, parsing it as JSON if the data content type is JSON
+func decodeBase64Data(event map[string]interface{}) error {
+	encoded, ok := event["data_base64"].(string)
+	if !ok {
+		return nil
+	}
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid data_base64: %w", err)
+	}
+	delete(event, "data_base64")
+	mediaType, _, _ := mime.ParseMediaType(attribute(event, "datacontenttype"))
+	if isJSON(mediaType) {
+		var data interface{}
+		if err := json.Unmarshal(content, &data); err != nil {
+			return fmt.Errorf("invalid event data: %w", err)
+		}
+		event["data"] = data
+		return nil
+	}
+	event["data"] = string(content)
+	return nil
+}
+
+// isJSON returns true if data of mediaType is JSON. CloudEvents data
+// without content type is JSON.
+func isJSON(mediaType string) bool {
+	return mediaType == "" || mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateCloudEvent checks that event has the required attributes of
+// CloudEvents 1.0
+func validateCloudEvent(event map[string]interface{}) error {
+	if v := attribute(event, "specversion"); v != "1.0" {
+		return fmt.Errorf("unsupported CloudEvents specversion %q", v)
+	}
+	for _, name := range []string{"id", "source", "type"} {
+		if attribute(event, name) == "" {
+			return fmt.Errorf("CloudEvent is missing required attribute %v", name)
+		}
+	}
+	return nil
+}
+
+// attribute returns the string attribute name of event
+func attribute(event map[string]interface{}, name string) string {
+	v, _ := event[name].(string)
+	return v
+}
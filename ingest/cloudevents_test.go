@@ -0,0 +1,135 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package ingest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const cloudEventsConfig = `
+cloudevents:
+  - match: '.type == "com.example.health.changed"'
+    status: '.data.healthy | not'
+    severity: .data.severity
+    labels:
+      alertname: '"ServiceUnhealthy"'
+    annotations:
+      message: .data.message
+  - match: '.type | startswith("com.example.")'
+    severity: '"warning"'
+`
+
+const structuredEvent = `{
+  "specversion": "1.0",
+  "id": "1",
+  "type": "com.example.health.changed",
+  "source": "/services/billing",
+  "subject": "db",
+  "data": {"healthy": false, "severity": "critical", "message": "database unreachable"}
+}`
+
+func TestDecodeCloudEventsStructured(t *testing.T) {
+	cfg, err := Parse([]byte(cloudEventsConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	header := http.Header{"Content-Type": {"application/cloudevents+json; charset=utf-8"}}
+
+	data, err := cfg.DecodeCloudEvents(header, strings.NewReader(structuredEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "cloudevents", data.Receiver)
+	if !assert.Len(t, data.Alerts, 1) {
+		return
+	}
+	alert := data.Alerts[0]
+	assert.Equal(t, "firing", alert.Status)
+	assert.Equal(t, map[string]string{
+		"alertname": "ServiceUnhealthy",
+		"severity":  "critical",
+		"source":    "/services/billing",
+		"subject":   "db",
+	}, map[string]string(alert.Labels))
+	assert.Equal(t, "database unreachable", alert.Annotations["message"])
+}
+
+func TestDecodeCloudEventsBatch(t *testing.T) {
+	cfg, err := Parse([]byte(cloudEventsConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	header := http.Header{"Content-Type": {"application/cloudevents-batch+json"}}
+	batch := `[
+  {"specversion": "1.0", "id": "1", "type": "com.example.health.changed", "source": "/a",
+   "datacontenttype": "application/json", "data_base64": "eyJoZWFsdGh5IjogdHJ1ZX0="},
+  {"specversion": "1.0", "id": "2", "type": "com.example.deploy.failed", "source": "/b"},
+  {"specversion": "1.0", "id": "3", "type": "org.other.event", "source": "/c"}
+]`
+
+	data, err := cfg.DecodeCloudEvents(header, strings.NewReader(batch))
+	assert.NoError(t, err)
+	if !assert.Len(t, data.Alerts, 2, "events without matching rule are ignored") {
+		return
+	}
+	assert.Equal(t, "resolved", data.Alerts[0].Status, "base64 encoded data is decoded")
+	assert.Equal(t, "com.example.deploy.failed", data.Alerts[1].Labels["alertname"], "alertname defaults to the event type")
+	assert.Equal(t, "warning", data.Alerts[1].Labels["severity"])
+	assert.Equal(t, "firing", data.Status)
+}
+
+func TestDecodeCloudEventsBinary(t *testing.T) {
+	cfg, err := Parse([]byte(cloudEventsConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("ce-specversion", "1.0")
+	header.Set("ce-id", "1")
+	header.Set("ce-type", "com.example.health.changed")
+	header.Set("ce-source", "/services/billing")
+
+	data, err := cfg.DecodeCloudEvents(header, strings.NewReader(`{"healthy": true, "severity": "critical"}`))
+	assert.NoError(t, err)
+	if assert.Len(t, data.Alerts, 1) {
+		assert.Equal(t, "resolved", data.Alerts[0].Status)
+		assert.Equal(t, "/services/billing", data.Alerts[0].Labels["source"])
+	}
+}
+
+func TestDecodeCloudEventsInvalid(t *testing.T) {
+	cfg, err := Parse([]byte(cloudEventsConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	structured := http.Header{"Content-Type": {"application/cloudevents+json"}}
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   string
+	}{
+		"not a CloudEvent":     {http.Header{"Content-Type": {"application/json"}}, `{}`},
+		"invalid JSON":         {structured, `{`},
+		"missing attribute":    {structured, `{"specversion": "1.0", "id": "1", "type": "t"}`},
+		"unsupported version":  {structured, `{"specversion": "0.3", "id": "1", "type": "t", "source": "s"}`},
+		"invalid base64 data":  {structured, `{"specversion": "1.0", "id": "1", "type": "t", "source": "s", "data_base64": "!"}`},
+		"invalid content type": {http.Header{"Content-Type": {";"}}, `{}`},
+	} {
+		_, err := cfg.DecodeCloudEvents(tc.header, strings.NewReader(tc.body))
+		assert.Error(t, err, name)
+	}
+
+	_, err = Parse([]byte("cloudevents:\n  - events: .items[]\n"))
+	assert.Error(t, err, "rules map single events")
+	_, err = Parse([]byte("cloudevents:\n  - match: '.type =='\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,316 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package ingest maps arbitrary JSON events to Alertmanager alerts, using
+// jq expressions which are configured per source
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Source configures how the events of a single source are mapped to
+// alerts. All fields are jq expressions, which are evaluated against each
+// event, except for Events, which is evaluated against the request body.
+type Source struct {
+	// Events selects the events in the request body. Each output of the
+	// expression is an event. Defaults to ".".
+	Events string `yaml:"events"`
+	// Status evaluates to firing or resolved, or to a boolean which is
+	// true if the alert is firing. Defaults to firing.
+	Status string `yaml:"status"`
+	// Severity is set as severity label
+	Severity string `yaml:"severity"`
+	// Labels identify the alert. The alertname label defaults to the name
+	// of the source.
+	Labels map[string]string `yaml:"labels"`
+	// Annotations carry additional information about the alert
+	Annotations map[string]string `yaml:"annotations"`
+	// GeneratorURL is linked as action URL
+	GeneratorURL string `yaml:"generator_url"`
+
+	name         string
+	events       *gojq.Code
+	status       *gojq.Code
+	severity     *gojq.Code
+	labels       map[string]*gojq.Code
+	annotations  map[string]*gojq.Code
+	generatorURL *gojq.Code
+}
+
+// Config is the ingestion configuration
+type Config struct {
+	// Sources of the generic JSON ingestion endpoint by name
+	Sources map[string]*Source `yaml:"sources"`
+	// CloudEvents rules, of which the first matching one maps a CloudEvent
+	// to an alert
+	CloudEvents []*Rule `yaml:"cloudevents"`
+}
+
+// sourceName restricts source names to characters which can be used in
+// URL paths without escaping
+var sourceName = regexp.MustCompile(`^[-_.a-zA-Z0-9]+$`)
+
+// Load reads the YAML configuration file at path and compiles the
+// expressions of all sources and rules
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ingestion config: %w", err)
+	}
+	return Parse(content)
+}
+
+// Parse parses the YAML ingestion configuration and compiles the
+// expressions of all sources and rules
+func Parse(content []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing ingestion config: %w", err)
+	}
+	for name, source := range cfg.Sources {
+		if !sourceName.MatchString(name) {
+			return nil, fmt.Errorf("source name %q may only contain letters, digits, '-', '_' and '.'", name)
+		}
+		if source == nil {
+			source = &Source{}
+			cfg.Sources[name] = source
+		}
+		if err := source.compile(name); err != nil {
+			return nil, fmt.Errorf("source %v: %w", name, err)
+		}
+	}
+	for i, rule := range cfg.CloudEvents {
+		if rule == nil {
+			return nil, fmt.Errorf("cloudevents rule %v is empty", i)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("cloudevents rule %v: %w", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// compile compiles the expressions of the source
+func (s *Source) compile(name string) error {
+	s.name = name
+	var err error
+	compile := func(field, expr, fallback string) *gojq.Code {
+		if err != nil {
+			return nil
+		}
+		if expr == "" {
+			if fallback == "" {
+				return nil
+			}
+			expr = fallback
+		}
+		var query *gojq.Query
+		if query, err = gojq.Parse(expr); err != nil {
+			err = fmt.Errorf("%v: %w", field, err)
+			return nil
+		}
+		var code *gojq.Code
+		if code, err = gojq.Compile(query); err != nil {
+			err = fmt.Errorf("%v: %w", field, err)
+		}
+		return code
+	}
+	s.events = compile("events", s.Events, ".")
+	s.status = compile("status", s.Status, "")
+	s.severity = compile("severity", s.Severity, "")
+	s.generatorURL = compile("generator_url", s.GeneratorURL, "")
+	s.labels = map[string]*gojq.Code{}
+	for k, expr := range s.Labels {
+		s.labels[k] = compile("labels."+k, expr, "")
+	}
+	s.annotations = map[string]*gojq.Code{}
+	for k, expr := range s.Annotations {
+		s.annotations[k] = compile("annotations."+k, expr, "")
+	}
+	return err
+}
+
+// Decode maps the JSON events in body to alerts
+func (s *Source) Decode(body io.Reader) (template.Data, error) {
+	var input interface{}
+	if err := json.NewDecoder(body).Decode(&input); err != nil {
+		return template.Data{}, err
+	}
+	data := template.Data{
+		Receiver: s.name,
+		Status:   string(model.AlertResolved),
+		Alerts:   template.Alerts{},
+	}
+	iter := s.events.Run(input)
+	for {
+		event, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := event.(error); ok {
+			return template.Data{}, fmt.Errorf("events: %w", err)
+		}
+		alert, err := s.alert(event, template.KV{"alertname": s.name})
+		if err != nil {
+			return template.Data{}, err
+		}
+		if alert.Status == string(model.AlertFiring) {
+			data.Status = string(model.AlertFiring)
+		}
+		data.Alerts = append(data.Alerts, alert)
+	}
+	return data, nil
+}
+
+// alert maps a single event to an alert. defaults are set as labels, if
+// the labels aren't mapped from the event.
+func (s *Source) alert(event interface{}, defaults template.KV) (template.Alert, error) {
+	alert := template.Alert{
+		Status:      string(model.AlertFiring),
+		Labels:      template.KV{},
+		Annotations: template.KV{},
+	}
+	var err error
+	eval := func(field string, code *gojq.Code) string {
+		if err != nil || code == nil {
+			return ""
+		}
+		var v string
+		if v, err = evalString(code, event); err != nil {
+			err = fmt.Errorf("%v: %w", field, err)
+		}
+		return v
+	}
+
+	if s.status != nil {
+		v, serr := evalFirst(s.status, event)
+		if serr != nil {
+			return alert, fmt.Errorf("status: %w", serr)
+		}
+		if alert.Status, serr = parseStatus(v); serr != nil {
+			return alert, fmt.Errorf("status: %w", serr)
+		}
+	}
+	for k, code := range s.labels {
+		if v := eval("labels."+k, code); v != "" {
+			alert.Labels[k] = v
+		}
+	}
+	if v := eval("severity", s.severity); v != "" {
+		alert.Labels["severity"] = v
+	}
+	for k, v := range defaults {
+		if alert.Labels[k] == "" && v != "" {
+			alert.Labels[k] = v
+		}
+	}
+	for k, code := range s.annotations {
+		if v := eval("annotations."+k, code); v != "" {
+			alert.Annotations[k] = v
+		}
+	}
+	alert.GeneratorURL = eval("generator_url", s.generatorURL)
+	if err != nil {
+		return alert, err
+	}
+	alert.Fingerprint = labelSet(alert.Labels).Fingerprint().String()
+	return alert, nil
+}
+
+// labelSet converts labels to a Prometheus label set
+func labelSet(labels template.KV) model.LabelSet {
+	set := model.LabelSet{}
+	for k, v := range labels {
+		set[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return set
+}
+
+// evalFirst returns the first output of code for input, or nil if there is
+// no output
+func evalFirst(code *gojq.Code, input interface{}) (interface{}, error) {
+	v, ok := code.Run(input).Next()
+	if !ok {
+		return nil, nil
+	}
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	return v, nil
+}
+
+// evalString returns the first output of code for input as string. Objects
+// and arrays are rendered as JSON. null and no output result in an empty
+// string.
+func evalString(code *gojq.Code, input interface{}) (string, error) {
+	v, err := evalFirst(code, input)
+	if err != nil {
+		return "", err
+	}
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	default:
+		out, err := json.Marshal(val)
+		return string(out), err
+	}
+}
+
+// parseStatus converts the output of a status expression to an alert status
+func parseStatus(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return string(model.AlertFiring), nil
+	case bool:
+		if val {
+			return string(model.AlertFiring), nil
+		}
+		return string(model.AlertResolved), nil
+	case string:
+		status := strings.ToLower(val)
+		if status == string(model.AlertFiring) || status == string(model.AlertResolved) {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("%v is neither firing, resolved nor a boolean", v)
+}
+
+// Names returns the sorted names of the sources
+func Names(sources map[string]*Source) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,120 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package ingest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+sources:
+  ci:
+    events: .builds[]
+    status: 'if .result == "failure" then "firing" else "resolved" end'
+    severity: '"critical"'
+    labels:
+      alertname: '"BuildFailed"'
+      pipeline: .pipeline
+      attempt: .attempt
+    annotations:
+      message: '"Build \(.number) of \(.pipeline) failed"'
+      details: .details
+    generator_url: .url
+  cron:
+    status: .ok | not
+`
+
+const ciEvents = `{
+  "builds": [
+    {"pipeline": "deploy", "number": 42, "attempt": 2, "result": "failure", "url": "https://ci/42", "details": {"step": "test"}},
+    {"pipeline": "lint", "number": 43, "attempt": 1, "result": "success", "url": "https://ci/43"}
+  ]
+}`
+
+func TestDecode(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"ci", "cron"}, Names(cfg.Sources))
+
+	data, err := cfg.Sources["ci"].Decode(strings.NewReader(ciEvents))
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", data.Receiver)
+	assert.Equal(t, "firing", data.Status)
+	if !assert.Len(t, data.Alerts, 2) {
+		return
+	}
+	failed, succeeded := data.Alerts[0], data.Alerts[1]
+	assert.Equal(t, "firing", failed.Status)
+	assert.Equal(t, map[string]string{"alertname": "BuildFailed", "pipeline": "deploy", "attempt": "2", "severity": "critical"}, map[string]string(failed.Labels))
+	assert.Equal(t, "Build 42 of deploy failed", failed.Annotations["message"])
+	assert.Equal(t, `{"step":"test"}`, failed.Annotations["details"], "objects are rendered as JSON")
+	assert.Equal(t, "https://ci/42", failed.GeneratorURL)
+	assert.NotEmpty(t, failed.Fingerprint)
+
+	assert.Equal(t, "resolved", succeeded.Status)
+	assert.NotContains(t, succeeded.Annotations, "details", "null values are omitted")
+	assert.NotEqual(t, failed.Fingerprint, succeeded.Fingerprint)
+}
+
+func TestDecodeDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data, err := cfg.Sources["cron"].Decode(strings.NewReader(`{"ok": true}`))
+	assert.NoError(t, err)
+	if assert.Len(t, data.Alerts, 1) {
+		assert.Equal(t, "resolved", data.Alerts[0].Status)
+		assert.Equal(t, "cron", data.Alerts[0].Labels["alertname"], "alertname defaults to the source name")
+	}
+
+	_, err = cfg.Sources["ci"].Decode(strings.NewReader(`{"builds": [{"result": "failure", "attempt": [1]}], `))
+	assert.Error(t, err, "invalid JSON")
+	_, err = cfg.Sources["ci"].Decode(strings.NewReader(`{"builds": 1}`))
+	assert.Error(t, err, "events expression fails")
+
+	cfg, err = Parse([]byte("sources:\n  bad:\n    status: .state\n"))
+	assert.NoError(t, err)
+	_, err = cfg.Sources["bad"].Decode(strings.NewReader(`{"state": "broken"}`))
+	assert.Error(t, err, "status must be firing, resolved or a boolean")
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, cfg := range map[string]string{
+		"invalid name":       "sources:\n  a/b: {}\n",
+		"unknown field":      "sources:\n  a:\n    labls: {}\n",
+		"invalid expression": "sources:\n  a:\n    labels:\n      x: .foo[\n",
+		"unknown function":   "sources:\n  a:\n    severity: nosuchfunc\n",
+	} {
+		_, err := Parse([]byte(cfg))
+		assert.Error(t, err, name)
+	}
+	_, err := Parse([]byte("sources:\n  a:\n    labels:\n      x: .foo[\n"))
+	assert.Contains(t, err.Error(), "labels.x", "the error names the field")
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ingest.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testConfig), 0600))
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Sources, 2)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FileLease stores the lease in a file on a filesystem shared by all
+// replicas. Concurrent access is serialized with an advisory lock on the
+// file.
+type FileLease struct {
+	path string
+}
+
+// NewFileLease creates a lease which is stored in the file at path
+func NewFileLease(path string) *FileLease {
+	return &FileLease{path: path}
+}
+
+// Describe implements Lease
+func (f *FileLease) Describe() string {
+	return fmt.Sprintf("file:%v", f.path)
+}
+
+// update runs modify on the lease record while holding the file lock, and
+// writes the record back if modify returns true
+func (f *FileLease) update(modify func(r *leaseRecord) bool) error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("locking %v: %w", f.path, err)
+	}
+	defer unlockFile(file)
+
+	var record leaseRecord
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("parsing %v: %w", f.path, err)
+		}
+	}
+
+	if !modify(&record) {
+		return nil
+	}
+
+	data, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// TryAcquireOrRenew implements Lease
+func (f *FileLease) TryAcquireOrRenew(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error) {
+	held := false
+	err := f.update(func(r *leaseRecord) bool {
+		held = r.acquire(identity, duration, now)
+		return held
+	})
+	return held && err == nil, err
+}
+
+// Release implements Lease
+func (f *FileLease) Release(ctx context.Context, identity string) error {
+	return f.update(func(r *leaseRecord) bool {
+		if r.HolderIdentity != identity {
+			return false
+		}
+		r.HolderIdentity = ""
+		return true
+	})
+}
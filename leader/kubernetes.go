@@ -0,0 +1,258 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// microTimeFormat is the format of metav1.MicroTime
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// KubernetesLease stores the lease in a coordination.k8s.io/v1 Lease object
+type KubernetesLease struct {
+	apiURL    string
+	namespace string
+	name      string
+	token     string
+	client    *http.Client
+}
+
+// kubeLease is the subset of a coordination.k8s.io/v1 Lease which
+// Signalilo uses
+type kubeLease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   kubeMetadata  `json:"metadata"`
+	Spec       kubeLeaseSpec `json:"spec"`
+}
+
+type kubeMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type kubeLeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// NewKubernetesLease creates a lease stored in the Lease object name in
+// namespace, which is accessed through the Kubernetes API at apiURL with
+// the given bearer token. If client is nil, http.DefaultClient is used.
+func NewKubernetesLease(apiURL, namespace, name, token string, client *http.Client) *KubernetesLease {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &KubernetesLease{
+		apiURL:    strings.TrimRight(apiURL, "/"),
+		namespace: namespace,
+		name:      name,
+		token:     token,
+		client:    client,
+	}
+}
+
+// NewInClusterKubernetesLease creates a lease stored in the Lease object
+// name, using the service account of the pod to access the Kubernetes API.
+// If namespace is empty, the pod's namespace is used.
+func NewInClusterKubernetesLease(namespace, name string) (*KubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %v/ca.crt", serviceAccountDir)
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		},
+	}
+	apiURL := fmt.Sprintf("https://%v:%v", host, port)
+	if strings.Contains(host, ":") {
+		// IPv6 address
+		apiURL = fmt.Sprintf("https://[%v]:%v", host, port)
+	}
+	return NewKubernetesLease(apiURL, namespace, name, strings.TrimSpace(string(token)), client), nil
+}
+
+// Describe implements Lease
+func (k *KubernetesLease) Describe() string {
+	return fmt.Sprintf("lease:%v/%v", k.namespace, k.name)
+}
+
+func (k *KubernetesLease) url(withName bool) string {
+	u := fmt.Sprintf("%v/apis/coordination.k8s.io/v1/namespaces/%v/leases", k.apiURL, k.namespace)
+	if withName {
+		u = u + "/" + k.name
+	}
+	return u
+}
+
+// request sends a request to the Kubernetes API and decodes the response
+// into result. It returns the HTTP status code.
+func (k *KubernetesLease) request(ctx context.Context, method, url string, body interface{}, result interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%v %v: %v: %s", method, url, resp.Status, msg)
+	}
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// toRecord converts the lease spec to a leaseRecord
+func (s kubeLeaseSpec) toRecord() leaseRecord {
+	var r leaseRecord
+	if s.HolderIdentity != nil {
+		r.HolderIdentity = *s.HolderIdentity
+	}
+	if s.LeaseDurationSeconds != nil {
+		r.LeaseDurationSeconds = *s.LeaseDurationSeconds
+	}
+	if s.AcquireTime != nil {
+		r.AcquireTime, _ = time.Parse(microTimeFormat, *s.AcquireTime)
+	}
+	if s.RenewTime != nil {
+		r.RenewTime, _ = time.Parse(microTimeFormat, *s.RenewTime)
+	}
+	if s.LeaseTransitions != nil {
+		r.LeaseTransitions = *s.LeaseTransitions
+	}
+	return r
+}
+
+// fromRecord creates a lease spec from a leaseRecord
+func fromRecord(r leaseRecord) kubeLeaseSpec {
+	acquireTime := r.AcquireTime.UTC().Format(microTimeFormat)
+	renewTime := r.RenewTime.UTC().Format(microTimeFormat)
+	return kubeLeaseSpec{
+		HolderIdentity:       &r.HolderIdentity,
+		LeaseDurationSeconds: &r.LeaseDurationSeconds,
+		AcquireTime:          &acquireTime,
+		RenewTime:            &renewTime,
+		LeaseTransitions:     &r.LeaseTransitions,
+	}
+}
+
+// TryAcquireOrRenew implements Lease. Concurrent updates are detected
+// through the Lease object's resource version.
+func (k *KubernetesLease) TryAcquireOrRenew(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error) {
+	var lease kubeLease
+	status, err := k.request(ctx, http.MethodGet, k.url(true), nil, &lease)
+	if status == http.StatusNotFound {
+		var record leaseRecord
+		record.acquire(identity, duration, now)
+		lease = kubeLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kubeMetadata{Name: k.name, Namespace: k.namespace},
+			Spec:       fromRecord(record),
+		}
+		status, err = k.request(ctx, http.MethodPost, k.url(false), lease, nil)
+		if status == http.StatusConflict {
+			// Somebody else created the lease first
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	record := lease.Spec.toRecord()
+	if !record.acquire(identity, duration, now) {
+		return false, nil
+	}
+	lease.Spec = fromRecord(record)
+	status, err = k.request(ctx, http.MethodPut, k.url(true), lease, nil)
+	if status == http.StatusConflict {
+		// Somebody else updated the lease since we read it
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release implements Lease
+func (k *KubernetesLease) Release(ctx context.Context, identity string) error {
+	var lease kubeLease
+	if _, err := k.request(ctx, http.MethodGet, k.url(true), nil, &lease); err != nil {
+		return err
+	}
+	record := lease.Spec.toRecord()
+	if record.HolderIdentity != identity {
+		return nil
+	}
+	record.HolderIdentity = ""
+	lease.Spec = fromRecord(record)
+	_, err := k.request(ctx, http.MethodPut, k.url(true), lease, nil)
+	return err
+}
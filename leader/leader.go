@@ -0,0 +1,188 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package leader implements lease-based leader election between Signalilo
+// replicas.
+package leader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bketelsen/logr"
+)
+
+// Lease is a lock which is held by at most one holder at a time and expires
+// if it isn't renewed
+type Lease interface {
+	// TryAcquireOrRenew acquires the lease for identity if it's free or
+	// expired, or renews it if identity already holds it. It returns
+	// whether identity holds the lease afterwards.
+	TryAcquireOrRenew(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error)
+	// Release gives up the lease if identity holds it
+	Release(ctx context.Context, identity string) error
+	// Describe returns a human-readable description of the lease
+	Describe() string
+}
+
+// Elector periodically tries to acquire or renew a lease and tracks whether
+// this instance is the leader. Elector is safe for concurrent use.
+type Elector struct {
+	lease         Lease
+	identity      string
+	leaseDuration time.Duration
+	onChange      func(leader bool)
+	logger        logr.Logger
+
+	mutex     sync.RWMutex
+	leader    bool
+	lastRenew time.Time
+}
+
+// NewElector creates an Elector for identity. onChange is called whenever
+// leadership is gained or lost.
+func NewElector(lease Lease, identity string, leaseDuration time.Duration, onChange func(leader bool), l logr.Logger) *Elector {
+	return &Elector{
+		lease:         lease,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		onChange:      onChange,
+		logger:        l,
+	}
+}
+
+// IsLeader returns true if this instance currently holds the lease
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leader
+}
+
+// Identity returns the identity with which the Elector competes for the
+// lease
+func (e *Elector) Identity() string {
+	return e.identity
+}
+
+// setLeader updates the leadership state and notifies onChange
+func (e *Elector) setLeader(leader bool) {
+	e.mutex.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if leader {
+		e.logger.Infof("Acquired leader lease %v as %v", e.lease.Describe(), e.identity)
+	} else {
+		e.logger.Infof("Lost leader lease %v", e.lease.Describe())
+	}
+	if e.onChange != nil {
+		e.onChange(leader)
+	}
+}
+
+// renewDeadline returns how long the leader keeps leadership after the last
+// successful renewal. It's shorter than the lease duration, so the leader
+// gives up leadership before another instance can acquire the expired
+// lease.
+func (e *Elector) renewDeadline() time.Duration {
+	return e.leaseDuration * 2 / 3
+}
+
+// retryPeriod returns the interval between election rounds. The leader
+// notices that the renew deadline has passed at the latest one retry period
+// later, which is still before the lease expires.
+func (e *Elector) retryPeriod() time.Duration {
+	return e.leaseDuration / 6
+}
+
+// tryAcquireOrRenew runs a single election round at ts
+func (e *Elector) tryAcquireOrRenew(ctx context.Context, ts time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, e.retryPeriod())
+	defer cancel()
+	held, err := e.lease.TryAcquireOrRenew(ctx, e.identity, e.leaseDuration, ts)
+	if err != nil {
+		e.logger.Errorf("Unable to acquire or renew leader lease %v: %v", e.lease.Describe(), err)
+		// Keep leadership until the renew deadline, so a single failed
+		// renewal doesn't stop the leader
+		e.mutex.RLock()
+		expired := ts.Sub(e.lastRenew) >= e.renewDeadline()
+		e.mutex.RUnlock()
+		if expired {
+			e.setLeader(false)
+		}
+		return
+	}
+	if held {
+		e.mutex.Lock()
+		e.lastRenew = ts
+		e.mutex.Unlock()
+	}
+	e.setLeader(held)
+}
+
+// Run takes part in the election until ctx is done. The lease is renewed
+// six times per lease duration. When ctx is done, the lease is released if
+// it's held.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.retryPeriod())
+	defer ticker.Stop()
+
+	e.tryAcquireOrRenew(ctx, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.lease.Release(releaseCtx, e.identity); err != nil {
+					e.logger.Errorf("Unable to release leader lease %v: %v", e.lease.Describe(), err)
+				}
+				cancel()
+				e.setLeader(false)
+			}
+			return
+		case ts := <-ticker.C:
+			e.tryAcquireOrRenew(ctx, ts)
+		}
+	}
+}
+
+// leaseRecord is the state of a lease which is stored by the Lease
+// implementations
+type leaseRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaseTransitions     int       `json:"leaseTransitions"`
+}
+
+// acquire updates record for identity at now, if identity may hold the
+// lease. It returns false if the lease is held by somebody else and hasn't
+// expired yet.
+func (r *leaseRecord) acquire(identity string, duration time.Duration, now time.Time) bool {
+	expiry := r.RenewTime.Add(time.Duration(r.LeaseDurationSeconds) * time.Second)
+	if r.HolderIdentity != "" && r.HolderIdentity != identity && now.Before(expiry) {
+		return false
+	}
+	if r.HolderIdentity != identity {
+		r.HolderIdentity = identity
+		r.AcquireTime = now
+		r.LeaseTransitions++
+	}
+	r.RenewTime = now
+	// Round up, so the lease doesn't expire before its holder assumes
+	r.LeaseDurationSeconds = int(math.Ceil(duration.Seconds()))
+	return true
+}
@@ -0,0 +1,239 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corvus-ch/logr/buffered"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingLease is a lease whose backend is unreachable
+type failingLease struct{}
+
+func (failingLease) TryAcquireOrRenew(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error) {
+	return false, fmt.Errorf("backend unreachable")
+}
+
+func (failingLease) Release(ctx context.Context, identity string) error {
+	return fmt.Errorf("backend unreachable")
+}
+
+func (failingLease) Describe() string {
+	return "failing"
+}
+
+// testLeaseSemantics checks the behavior which all Lease implementations
+// must share
+func testLeaseSemantics(t *testing.T, lease Lease) {
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	duration := 15 * time.Second
+
+	held, err := lease.TryAcquireOrRenew(ctx, "a", duration, now)
+	assert.NoError(t, err)
+	assert.True(t, held, "free lease is acquired")
+
+	held, err = lease.TryAcquireOrRenew(ctx, "b", duration, now.Add(5*time.Second))
+	assert.NoError(t, err)
+	assert.False(t, held, "lease held by somebody else isn't acquired")
+
+	held, err = lease.TryAcquireOrRenew(ctx, "a", duration, now.Add(10*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, held, "holder renews the lease")
+
+	held, err = lease.TryAcquireOrRenew(ctx, "b", duration, now.Add(20*time.Second))
+	assert.NoError(t, err)
+	assert.False(t, held, "renewed lease hasn't expired yet")
+
+	held, err = lease.TryAcquireOrRenew(ctx, "b", duration, now.Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, held, "expired lease is taken over")
+
+	assert.NoError(t, lease.Release(ctx, "a"), "releasing a lease which isn't held is a no-op")
+	held, err = lease.TryAcquireOrRenew(ctx, "a", duration, now.Add(31*time.Second))
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	assert.NoError(t, lease.Release(ctx, "b"))
+	held, err = lease.TryAcquireOrRenew(ctx, "a", duration, now.Add(32*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, held, "released lease is acquired immediately")
+}
+
+func TestFileLease(t *testing.T) {
+	testLeaseSemantics(t, NewFileLease(filepath.Join(t.TempDir(), "lease")))
+}
+
+// fakeLeaseAPI implements the subset of the Kubernetes coordination.k8s.io/v1
+// API used by KubernetesLease
+type fakeLeaseAPI struct {
+	mutex   sync.Mutex
+	lease   *kubeLease
+	version int
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const collection = "/apis/coordination.k8s.io/v1/namespaces/signalilo/leases"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == collection+"/signalilo":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(f.lease)
+	case r.Method == http.MethodPost && r.URL.Path == collection:
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(w, r)
+	case r.Method == http.MethodPut && r.URL.Path == collection+"/signalilo":
+		var lease kubeLease
+		_ = json.NewDecoder(r.Body).Decode(&lease)
+		if f.lease == nil || lease.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.lease = &lease
+		f.bump(w)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeLeaseAPI) store(w http.ResponseWriter, r *http.Request) {
+	var lease kubeLease
+	_ = json.NewDecoder(r.Body).Decode(&lease)
+	f.lease = &lease
+	f.bump(w)
+}
+
+func (f *fakeLeaseAPI) bump(w http.ResponseWriter) {
+	f.version++
+	f.lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	_ = json.NewEncoder(w).Encode(f.lease)
+}
+
+func TestKubernetesLease(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	lease := NewKubernetesLease(server.URL, "signalilo", "signalilo", "token", nil)
+	testLeaseSemantics(t, lease)
+	assert.Equal(t, "a", *api.lease.Spec.HolderIdentity)
+	assert.Equal(t, 3, *api.lease.Spec.LeaseTransitions)
+}
+
+func TestKubernetesLeaseConflict(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	lease := NewKubernetesLease(server.URL, "signalilo", "signalilo", "token", nil)
+	now := time.Now()
+
+	held, err := lease.TryAcquireOrRenew(context.Background(), "a", time.Second, now)
+	assert.NoError(t, err)
+	assert.True(t, held)
+
+	// Somebody else updates the lease between our read and our write
+	api.mutex.Lock()
+	stale := *api.lease
+	api.version++
+	api.lease.Metadata.ResourceVersion = strconv.Itoa(api.version)
+	api.mutex.Unlock()
+	status, err := lease.request(context.Background(), http.MethodPut, lease.url(true), stale, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+func TestKubernetesLeaseUnauthorized(t *testing.T) {
+	server := httptest.NewServer(&fakeLeaseAPI{})
+	defer server.Close()
+	lease := NewKubernetesLease(server.URL, "signalilo", "signalilo", "wrong", nil)
+
+	held, err := lease.TryAcquireOrRenew(context.Background(), "a", time.Second, time.Now())
+	assert.Error(t, err)
+	assert.False(t, held)
+}
+
+func TestElectorSingleLeader(t *testing.T) {
+	lease := NewFileLease(filepath.Join(t.TempDir(), "lease"))
+	a := NewElector(lease, "a", 15*time.Second, nil, buffered.New(0))
+	b := NewElector(lease, "b", 15*time.Second, nil, buffered.New(0))
+	ctx := context.Background()
+	now := time.Now()
+
+	a.tryAcquireOrRenew(ctx, now)
+	b.tryAcquireOrRenew(ctx, now)
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	// a stops renewing, b takes over once the lease has expired
+	b.tryAcquireOrRenew(ctx, now.Add(10*time.Second))
+	assert.False(t, b.IsLeader())
+	b.tryAcquireOrRenew(ctx, now.Add(16*time.Second))
+	assert.True(t, b.IsLeader())
+	a.tryAcquireOrRenew(ctx, now.Add(17*time.Second))
+	assert.False(t, a.IsLeader(), "a notices that it lost the lease")
+}
+
+func TestElectorKeepsLeadershipOnTransientErrors(t *testing.T) {
+	var changes []bool
+	e := NewElector(failingLease{}, "a", 15*time.Second, func(leader bool) {
+		changes = append(changes, leader)
+	}, buffered.New(0))
+	now := time.Now()
+	e.lastRenew = now
+	e.setLeader(true)
+
+	e.tryAcquireOrRenew(context.Background(), now.Add(5*time.Second))
+	assert.True(t, e.IsLeader(), "leadership is kept until the renew deadline")
+	e.tryAcquireOrRenew(context.Background(), now.Add(10*time.Second))
+	assert.False(t, e.IsLeader(), "leadership is given up before the lease expires")
+	assert.Equal(t, []bool{true, false}, changes)
+}
+
+func TestElectorRunReleasesLease(t *testing.T) {
+	lease := NewFileLease(filepath.Join(t.TempDir(), "lease"))
+	a := NewElector(lease, "a", time.Minute, nil, buffered.New(0))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, a.IsLeader, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	assert.False(t, a.IsLeader())
+
+	held, err := lease.TryAcquireOrRenew(context.Background(), "b", time.Minute, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, held, "released lease is free for other instances")
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package leader
+
+import (
+	"fmt"
+	"os"
+)
+
+func lockFile(f *os.File) error {
+	return fmt.Errorf("file leases are not supported on windows")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
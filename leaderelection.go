@@ -0,0 +1,87 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/leader"
+)
+
+const (
+	leaderElectionNone       = "none"
+	leaderElectionKubernetes = "kubernetes"
+	leaderElectionFile       = "file"
+)
+
+// newLease creates the lease for the configured leader election mode. It
+// returns nil if leader election is disabled.
+func newLease(c config.SignaliloConfig) (leader.Lease, error) {
+	le := c.LeaderElection
+	switch le.Mode {
+	case leaderElectionNone, "":
+		return nil, nil
+	case leaderElectionKubernetes:
+		return leader.NewInClusterKubernetesLease(le.Namespace, le.LeaseName)
+	case leaderElectionFile:
+		if le.LockFile == "" {
+			return nil, fmt.Errorf("leader election mode %v requires a lock file", le.Mode)
+		}
+		return leader.NewFileLease(le.LockFile), nil
+	default:
+		return nil, fmt.Errorf("unknown leader election mode %v", le.Mode)
+	}
+}
+
+// isLeader returns true if this instance should run the heartbeat and the
+// garbage collector, and submit the watchdog state. Without leader
+// election, every instance is the leader.
+func (s *ServeCommand) isLeader() bool {
+	return s.elector == nil || s.elector.IsLeader()
+}
+
+// leadershipChanged records whether this instance is the leader, and
+// signals leaderAcquired when it becomes the leader. The elector calls it
+// while renewing the lease, so it mustn't block.
+func (s *ServeCommand) leadershipChanged(leader bool) {
+	s.stats.LeadershipChanged(leader)
+	if leader {
+		select {
+		case s.leaderAcquired <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startLeaderElection takes part in the leader election until ctx is done,
+// if leader election is enabled
+func (s *ServeCommand) startLeaderElection(ctx context.Context) error {
+	lease, err := newLease(s.config)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return nil
+	}
+	le := s.GetConfig().LeaderElection
+	s.logger.Infof("Starting leader election: %v, identity %v, lease duration %v", lease.Describe(), le.Identity, le.LeaseDuration)
+	s.stats.LeadershipChanged(false)
+	s.leaderAcquired = make(chan struct{}, 1)
+	s.elector = leader.NewElector(lease, le.Identity, le.LeaseDuration, s.leadershipChanged, s.logger)
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.elector.Run(ctx)
+	}()
+	return nil
+}
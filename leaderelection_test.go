@@ -0,0 +1,75 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/leader"
+	"github.com/vshn/signalilo/stats"
+)
+
+func TestNewLease(t *testing.T) {
+	var c config.SignaliloConfig
+
+	lease, err := newLease(c)
+	assert.NoError(t, err)
+	assert.Nil(t, lease, "leader election disabled by default")
+
+	c.LeaderElection.Mode = leaderElectionFile
+	_, err = newLease(c)
+	assert.Error(t, err, "file mode requires a lock file")
+
+	c.LeaderElection.LockFile = filepath.Join(t.TempDir(), "lease")
+	lease, err = newLease(c)
+	assert.NoError(t, err)
+	assert.IsType(t, &leader.FileLease{}, lease)
+
+	c.LeaderElection.Mode = "zookeeper"
+	_, err = newLease(c)
+	assert.Error(t, err)
+}
+
+func TestIsLeader(t *testing.T) {
+	s := &ServeCommand{}
+	assert.True(t, s.isLeader(), "every instance leads without leader election")
+
+	s.elector = leader.NewElector(leader.NewFileLease(filepath.Join(t.TempDir(), "lease")), "a", 0, nil, config.MockLogger(1))
+	assert.False(t, s.isLeader(), "instance is standby until it acquires the lease")
+}
+
+func TestHeartbeatWhenLeaseAcquired(t *testing.T) {
+	s := &ServeCommand{stats: stats.New()}
+	s.logger = config.MockLogger(1)
+	s.config.HostName = "signalilo_test"
+	s.config.HeartbeatInterval = time.Hour
+	s.config.LeaderElection.Mode = leaderElectionFile
+	s.config.LeaderElection.LockFile = filepath.Join(t.TempDir(), "lease")
+	s.config.LeaderElection.Identity = "a"
+	s.config.LeaderElection.LeaseDuration = time.Minute
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: "signalilo_test"})
+	_ = icinga.CreateService(icinga2.Service{Name: "heartbeat", HostName: "signalilo_test"})
+	s.icingaClient = icinga
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, s.startLeaderElection(ctx))
+	assert.NoError(t, s.startHeartbeat(ctx))
+	assert.Eventually(t, func() bool { return !s.stats.Snapshot().LastHeartbeat.IsZero() }, time.Second, time.Millisecond,
+		"heartbeat is sent when the lease is acquired")
+	cancel()
+	s.background.Wait()
+}
@@ -0,0 +1,239 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package logging implements logr.Logger on top of logrus, with support for
+// structured fields, several output formats and redaction of secrets
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bketelsen/logr"
+	"github.com/sirupsen/logrus"
+)
+
+// Output formats
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+	FormatText   = "text"
+)
+
+// Formats lists the supported output formats
+var Formats = []string{FormatJSON, FormatLogfmt, FormatText}
+
+// Names of the structured fields which are shared by all components
+const (
+	FieldRequestID   = "request_id"
+	FieldFingerprint = "alert_fingerprint"
+	FieldService     = "service"
+	FieldEndpoint    = "icinga_endpoint"
+	FieldOperation   = "operation"
+	// FieldDuration is the duration of the operation in seconds
+	FieldDuration = "duration"
+)
+
+// Redacted replaces secrets in log output
+const Redacted = "*****"
+
+// sensitiveFields are substrings of field names whose values are always
+// redacted
+var sensitiveFields = []string{"password", "token", "secret", "authorization"}
+
+// logger implements logr.Logger using a logrus entry, which carries the
+// structured fields
+type logger struct {
+	level     int
+	verbosity int
+	entry     *logrus.Entry
+}
+
+// New creates a logger which writes to out in the given format. Messages
+// with a V() level greater than verbosity are discarded. The given secrets
+// are redacted from messages and fields.
+func New(verbosity int, format string, out io.Writer, secrets ...string) (logr.Logger, error) {
+	var formatter logrus.Formatter
+	switch format {
+	case FormatJSON, "":
+		formatter = new(logrus.JSONFormatter)
+	case FormatLogfmt:
+		formatter = &logrus.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		}
+	case FormatText:
+		formatter = textFormatter{}
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected one of %v", format, strings.Join(Formats, ", "))
+	}
+	ll := &logrus.Logger{
+		Out:       out,
+		Formatter: newRedactingFormatter(formatter, secrets),
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	return &logger{verbosity: verbosity, entry: logrus.NewEntry(ll)}, nil
+}
+
+// NewDiscard creates a logger which discards all messages
+func NewDiscard(verbosity int) logr.Logger {
+	l, _ := New(verbosity, FormatText, io.Discard)
+	return l
+}
+
+// Info implements logr.Logger. Messages of a V() level greater than zero are
+// logged with debug level.
+func (l logger) Info(args ...interface{}) {
+	if l.Enabled() {
+		if l.level > 0 {
+			l.entry.Debug(args...)
+		} else {
+			l.entry.Info(args...)
+		}
+	}
+}
+
+// Infof implements logr.Logger
+func (l logger) Infof(format string, args ...interface{}) {
+	if l.Enabled() {
+		if l.level > 0 {
+			l.entry.Debugf(format, args...)
+		} else {
+			l.entry.Infof(format, args...)
+		}
+	}
+}
+
+// Enabled implements logr.Logger
+func (l logger) Enabled() bool {
+	return l.level <= l.verbosity
+}
+
+// Error implements logr.Logger
+func (l logger) Error(args ...interface{}) {
+	l.entry.Error(args...)
+}
+
+// Errorf implements logr.Logger
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+// V implements logr.Logger
+func (l logger) V(level int) logr.InfoLogger {
+	return &logger{level: level, verbosity: l.verbosity, entry: l.entry}
+}
+
+// NewWithPrefix implements logr.Logger by adding the field prefix
+func (l logger) NewWithPrefix(prefix string) logr.Logger {
+	return l.WithField("prefix", prefix)
+}
+
+// WithField implements logr.Logger
+func (l logger) WithField(name string, value interface{}) logr.Logger {
+	return &logger{level: l.level, verbosity: l.verbosity, entry: l.entry.WithField(name, value)}
+}
+
+// redactingFormatter removes secrets from log entries before they're
+// formatted
+type redactingFormatter struct {
+	formatter logrus.Formatter
+	replacer  *strings.Replacer
+}
+
+func newRedactingFormatter(formatter logrus.Formatter, secrets []string) *redactingFormatter {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, Redacted)
+		}
+	}
+	f := &redactingFormatter{formatter: formatter}
+	if len(pairs) > 0 {
+		f.replacer = strings.NewReplacer(pairs...)
+	}
+	return f
+}
+
+func (f *redactingFormatter) redact(s string) string {
+	if f.replacer == nil {
+		return s
+	}
+	return f.replacer.Replace(s)
+}
+
+func isSensitive(field string) bool {
+	field = strings.ToLower(field)
+	for _, s := range sensitiveFields {
+		if strings.Contains(field, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Format implements logrus.Formatter
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = f.redact(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch val := v.(type) {
+		case string:
+			v = f.redact(val)
+		case error:
+			v = f.redact(val.Error())
+		case fmt.Stringer:
+			v = f.redact(val.String())
+		}
+		if isSensitive(k) {
+			v = Redacted
+		}
+		redacted.Data[k] = v
+	}
+	return f.formatter.Format(&redacted)
+}
+
+// textFormatter formats entries for humans, as timestamp, level and
+// message, followed by the fields sorted by name
+type textFormatter struct{}
+
+// Format implements logrus.Formatter
+func (textFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%v %-5v %v", entry.Time.Format(time.RFC3339), strings.ToUpper(entry.Level.String()), strings.TrimRight(entry.Message, "\n"))
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fmt.Sprint(entry.Data[k])
+		if strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %v=%v", k, v)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// WithCall returns a logger for the outcome of the Icinga API call
+// operation to endpoint, which started at start
+func WithCall(l logr.Logger, operation, endpoint string, start time.Time) logr.Logger {
+	return l.WithField(FieldOperation, operation).
+		WithField(FieldEndpoint, endpoint).
+		WithField(FieldDuration, time.Since(start).Seconds())
+}
@@ -10,7 +10,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -25,9 +24,8 @@ var (
 func main() {
 	app := kingpin.New("signalilo", "Signalilo takes in Alertmanager alerts through a webhook, translates them into Icinga2 services and posts them to Icinga using the Icinga API").Version(Version)
 	configureServeCommand(app)
-
-	fmt.Printf("Signalilo %v\n", Version)
-	fmt.Printf("Build time: %v\n\n", BuildDate)
+	configureGCCommand(app)
+	configureAdoptCommand(app)
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 }
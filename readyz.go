@@ -0,0 +1,103 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vshn/signalilo/config"
+)
+
+// readinessCheck is the result of a single readiness check
+type readinessCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// readinessReport is returned by the readiness endpoint
+type readinessReport struct {
+	Ready  bool                      `json:"ready"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// heartbeatGraceFactor is the number of heartbeat intervals after which a
+// missing heartbeat makes Signalilo unready
+const heartbeatGraceFactor = 3
+
+// checkReadiness runs all readiness checks at ts
+func checkReadiness(ts time.Time, c config.Configuration) readinessReport {
+	cfg := c.GetConfig()
+	report := readinessReport{
+		Ready:  true,
+		Checks: map[string]readinessCheck{},
+	}
+	add := func(name string, ok bool, format string, args ...interface{}) {
+		report.Checks[name] = readinessCheck{OK: ok, Message: fmt.Sprintf(format, args...)}
+		report.Ready = report.Ready && ok
+	}
+
+	icinga := c.GetIcingaClient()
+	if icinga == nil {
+		add("icinga", false, "no Icinga API client")
+		add("service_host", false, "no Icinga API client")
+	} else {
+		if err := icinga.TestIcingaApi(); err != nil {
+			add("icinga", false, "Icinga API %v: %v", config.RedactURL(icinga.GetClientConfig().URL), err)
+		} else {
+			add("icinga", true, "Icinga API %v reachable", config.RedactURL(icinga.GetClientConfig().URL))
+		}
+		if _, err := icinga.GetHost(cfg.HostName); err != nil {
+			add("service_host", false, "service host %v: %v", cfg.HostName, err)
+		} else {
+			add("service_host", true, "service host %v exists", cfg.HostName)
+		}
+	}
+
+	current := c.GetStats().Snapshot()
+	if current.InFlight > cfg.HeartbeatBacklogThreshold {
+		add("queue", false, "%v webhook requests in flight, threshold %v", current.InFlight, cfg.HeartbeatBacklogThreshold)
+	} else {
+		add("queue", true, "%v webhook requests in flight", current.InFlight)
+	}
+
+	maxAge := heartbeatGraceFactor * cfg.HeartbeatInterval
+	switch {
+	case current.Standby:
+		add("heartbeat", true, "standby, the leader sends heartbeats")
+	case current.LastHeartbeat.IsZero():
+		add("heartbeat", false, "no heartbeat sent yet")
+	case ts.Sub(current.LastHeartbeat) > maxAge:
+		add("heartbeat", false, "last heartbeat sent at %v, more than %v ago", current.LastHeartbeat.Format(time.RFC3339), maxAge)
+	default:
+		add("heartbeat", true, "last heartbeat sent at %v", current.LastHeartbeat.Format(time.RFC3339))
+	}
+
+	return report
+}
+
+// readyz reports whether Signalilo is able to deliver alerts to Icinga
+func readyz(w http.ResponseWriter, r *http.Request, c config.Configuration) {
+	report := checkReadiness(time.Now(), c)
+	if !report.Ready {
+		c.GetLogger().Infof("Not ready: %+v", report.Checks)
+	}
+
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	bytes, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
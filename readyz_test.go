@@ -0,0 +1,73 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/stats"
+)
+
+func newReadinessTestCommand() (*ServeCommand, *icinga2.MockClient) {
+	s := &ServeCommand{stats: stats.New()}
+	s.logger = config.MockLogger(1)
+	s.config.HostName = "signalilo_test"
+	s.config.HeartbeatInterval = time.Minute
+	s.config.HeartbeatBacklogThreshold = 10
+	icinga := icinga2.NewMockClient()
+	icinga.SetIcingaUrl("https://icinga:5665")
+	s.icingaClient = icinga
+	return s, icinga
+}
+
+func TestReadiness(t *testing.T) {
+	s, icinga := newReadinessTestCommand()
+	ts := time.Now()
+
+	report := checkReadiness(ts, s)
+	assert.False(t, report.Ready)
+	assert.True(t, report.Checks["icinga"].OK)
+	assert.False(t, report.Checks["service_host"].OK, "service host missing")
+	assert.True(t, report.Checks["queue"].OK)
+	assert.False(t, report.Checks["heartbeat"].OK, "no heartbeat yet")
+
+	assert.NoError(t, icinga.CreateHost(icinga2.Host{Name: "signalilo_test"}))
+	s.stats.HeartbeatSent(ts.Add(-time.Minute))
+	report = checkReadiness(ts, s)
+	assert.True(t, report.Ready, "%+v", report.Checks)
+
+	report = checkReadiness(ts.Add(5*time.Minute), s)
+	assert.False(t, report.Ready)
+	assert.False(t, report.Checks["heartbeat"].OK, "heartbeat too old")
+}
+
+func TestReadinessStandby(t *testing.T) {
+	s, icinga := newReadinessTestCommand()
+	assert.NoError(t, icinga.CreateHost(icinga2.Host{Name: "signalilo_test"}))
+	s.stats.LeadershipChanged(false)
+
+	report := checkReadiness(time.Now(), s)
+	assert.True(t, report.Ready, "standby instances don't send heartbeats")
+	assert.True(t, report.Checks["heartbeat"].OK)
+}
+
+func TestReadyz(t *testing.T) {
+	s, _ := newReadinessTestCommand()
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { readyz(w, r, s) })
+
+	assert.HTTPStatusCode(t, handler, "GET", "http://example.com/readyz", nil, http.StatusServiceUnavailable)
+	assert.HTTPBodyContains(t, handler, "GET", "http://example.com/readyz", nil, `"service_host":{"ok":false`)
+}
@@ -10,15 +10,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/bketelsen/logr"
 	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
 	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/endpoint"
 	"github.com/vshn/signalilo/gc"
+	"github.com/vshn/signalilo/ingest"
+	"github.com/vshn/signalilo/leader"
+	"github.com/vshn/signalilo/logging"
+	"github.com/vshn/signalilo/stats"
+	"github.com/vshn/signalilo/tracing"
 	"github.com/vshn/signalilo/webhook"
 )
 
@@ -32,6 +45,21 @@ type ServeCommand struct {
 	icingaClient    icinga2.Client
 	heartbeatTicker *time.Ticker
 	gcTicker        *time.Ticker
+	watchdogTicker  *time.Ticker
+	startTime       time.Time
+	// background tracks the goroutines running background tasks
+	background sync.WaitGroup
+	stats      *stats.Stats
+	// lastHeartbeat holds the stats at the time of the previous heartbeat
+	lastHeartbeat stats.Snapshot
+	// elector is nil if leader election is disabled
+	elector *leader.Elector
+	// leaderAcquired is signalled when the elector acquires the lease
+	leaderAcquired chan struct{}
+	// auditLog is nil if no audit log is configured
+	auditLog *audit.Log
+	// ingestConfig maps generic JSON events and CloudEvents to alerts
+	ingestConfig *ingest.Config
 }
 
 // GetConfig implements config.Configuration
@@ -49,6 +77,21 @@ func (s *ServeCommand) GetIcingaClient() icinga2.Client {
 	return s.icingaClient
 }
 
+// GetStats implements config.Configuration
+func (s *ServeCommand) GetStats() *stats.Stats {
+	return s.stats
+}
+
+// GetAuditLog implements config.Configuration
+func (s *ServeCommand) GetAuditLog() *audit.Log {
+	return s.auditLog
+}
+
+// SetAuditLog implements config.Configuration
+func (s *ServeCommand) SetAuditLog(log *audit.Log) {
+	s.auditLog = log
+}
+
 // SetLogger implements config.Configuration
 func (s *ServeCommand) SetLogger(logger logr.Logger) {
 	s.logger = logger
@@ -61,13 +104,19 @@ func (s *ServeCommand) SetIcingaClient(client icinga2.Client) {
 
 func healthz(w http.ResponseWriter, r *http.Request, c config.Configuration) {
 	fmt.Fprint(w, "ok")
-	c.GetLogger().V(3).Infof("Config: %+v", c.GetConfig())
+	if icinga := c.GetIcingaClient(); icinga != nil {
+		fmt.Fprintf(w, "\nactive Icinga API: %v", icinga.GetClientConfig().URL)
+	}
+	c.GetLogger().V(3).Infof("Config: %+v", c.GetConfig().Redacted())
 }
 
 func (s *ServeCommand) heartbeat(ts time.Time) error {
 	icinga := s.GetIcingaClient()
 	config := s.GetConfig()
-	l := s.GetLogger()
+	l := s.GetLogger().WithField(logging.FieldOperation, "heartbeat").
+		WithField(logging.FieldService, fmt.Sprintf("%v!heartbeat", config.HostName))
+	ctx, span := tracing.Start(context.Background(), "heartbeat")
+	defer span.End()
 	_, err := icinga.GetHost(config.HostName)
 	if err != nil {
 		l.Errorf("heartbeat: unable to get servicehost: %v", err)
@@ -78,131 +127,348 @@ func (s *ServeCommand) heartbeat(ts time.Time) error {
 		l.Errorf("heartbeat: unable to get heartbeat service: %v", err)
 		return err
 	}
-	msg := fmt.Sprintf("OK: %v", ts.Format(time.RFC3339))
-	l.Infof("Sending heartbeat: '%v'", msg)
-	err = icinga.ProcessCheckResult(svc, icinga2.Action{
-		ExitStatus:   0,
-		PluginOutput: msg,
-	})
+	current := s.GetStats().Snapshot()
+	action := s.heartbeatResult(ts, current, s.lastHeartbeat, icinga.GetClientConfig().URL)
+	s.lastHeartbeat = current
+	l.Infof("Sending heartbeat: '%v'", action.PluginOutput)
+	start := time.Now()
+	_, callSpan := tracing.StartIcingaCall(ctx, "process_check_result", icinga.GetClientConfig().URL, tracing.AttrService.String(svc.Name))
+	err = icinga.ProcessCheckResult(svc, action)
+	tracing.End(callSpan, err)
+	s.recordCheckResult(ctx, audit.TriggerHeartbeat, svc, action, err)
+	l = logging.WithCall(l, "process_check_result", icinga.GetClientConfig().URL, start)
 	if err != nil {
 		l.Errorf("heartbeat: process_check_result: %v", err)
+		return nil
 	}
+	l.V(2).Infof("Sent heartbeat")
+	s.GetStats().HeartbeatSent(ts)
 	return nil
 }
 
-func (s *ServeCommand) startHeartbeat() error {
-	hbInterval := s.GetConfig().HeartbeatInterval
-	s.heartbeatTicker = time.NewTicker(hbInterval)
-	s.logger.Infof("Starting heartbeat: interval %v", hbInterval)
+// heartbeatResult computes the heartbeat check result from Signalilo's own
+// health. The error rate is computed over the alerts processed since the
+// previous heartbeat, whose stats are given in prev.
+func (s *ServeCommand) heartbeatResult(ts time.Time, current, prev stats.Snapshot, icingaURL string) icinga2.Action {
+	config := s.GetConfig()
 
-	go func() {
-		// Send initial heartbeat from goroutine to make server
-		// startup quicker
-		err := s.heartbeat(time.Now())
-		if err != nil {
-			s.logger.Errorf("Unable to send initial heartbeat: %v", err)
-		}
+	var problems []string
+	alerts := current.AlertsProcessed - prev.AlertsProcessed
+	errors := current.Errors - prev.Errors
+	if alerts > 0 && float64(errors)/float64(alerts) > config.HeartbeatErrorRateThreshold {
+		problems = append(problems, fmt.Sprintf("%v of %v alerts not delivered since last heartbeat", errors, alerts))
+	}
+	// Truncated alerts which couldn't be fetched never appear in Icinga
+	truncated := current.AlertsTruncated - prev.AlertsTruncated
+	recovered := current.AlertsRecovered - prev.AlertsRecovered
+	if truncated > recovered {
+		problems = append(problems, fmt.Sprintf("%v alerts truncated by Alertmanager since last heartbeat", truncated-recovered))
+	}
+	if current.InFlight > config.HeartbeatBacklogThreshold {
+		problems = append(problems, fmt.Sprintf("%v webhook requests in flight", current.InFlight))
+	}
+	if len(config.IcingaConfig.URL) > 0 && icingaURL != config.IcingaConfig.URL[0] {
+		problems = append(problems, fmt.Sprintf("failed over to Icinga API %v", icingaURL))
+	}
+	if current.GCError != nil {
+		problems = append(problems, fmt.Sprintf("garbage collection failing: %v", current.GCError))
+	}
+	if current.GC.Malformed > 0 {
+		problems = append(problems, fmt.Sprintf("%v managed services with malformed variables, see garbage collection log", current.GC.Malformed))
+	}
 
-		for ts := range s.heartbeatTicker.C {
-			if err := s.heartbeat(ts); err != nil {
-				s.logger.Errorf("sending heartbeat: %s", err)
+	exitStatus := 0
+	msg := fmt.Sprintf("OK: %v", ts.Format(time.RFC3339))
+	if len(problems) > 0 {
+		exitStatus = 1
+		msg = fmt.Sprintf("WARNING: %v: %v", ts.Format(time.RFC3339), strings.Join(problems, "; "))
+	}
 
-				// In some rare cases there could be an Icinga2 reload for a config update and the API is not reachable.
-				// So, the switch off of the Config-Master would take in place, but we don't want an unnecessary switch
-				// to the secondary Icinga2 instance.
-				if s.config.Reconnect > 0 {
-					s.logger.Infof("Waiting %s for reconnect", s.config.Reconnect)
-					time.Sleep(s.config.Reconnect)
-				}
+	perfData := icinga2.PerfData{
+		fmt.Sprintf("alerts_processed=%vc", current.AlertsProcessed),
+		fmt.Sprintf("errors=%vc", current.Errors),
+		fmt.Sprintf("in_flight=%v", current.InFlight),
+		fmt.Sprintf("alerts_truncated=%vc", current.AlertsTruncated),
+		fmt.Sprintf("alerts_recovered=%vc", current.AlertsRecovered),
+		fmt.Sprintf("gc_malformed=%v", current.GC.Malformed),
+	}
+	if !current.LastWebhook.IsZero() {
+		perfData = append(perfData, fmt.Sprintf("last_webhook_age=%.0fs", ts.Sub(current.LastWebhook).Seconds()))
+	}
 
-				erro := s.icingaClient.TestIcingaApi()
-
-				if erro != nil {
-					// Tests all configured '--icinga_url' and sets the URL which doesn't respond with error
-					for _, url := range s.config.IcingaConfig.URL {
-						s.icingaClient.SetIcingaUrl(url)
-						erri := s.icingaClient.TestIcingaApi()
-
-						if erri == nil {
-							s.logger.Infof("Switching to new Icinga-API-URL: %v", url)
-							break
-						} else {
-							continue
-						}
-					}
-				} else {
-					s.logger.Infof("Reconnect successful: %v", s.icingaClient.GetClientConfig().URL)
-					continue
-				}
-			}
+	return icinga2.Action{
+		ExitStatus:      exitStatus,
+		PluginOutput:    msg,
+		PerformanceData: perfData,
+		CheckSource:     config.CheckSource,
+		ExecutionStart:  webhook.IcingaTimestamp(ts),
+		ExecutionEnd:    webhook.IcingaTimestamp(ts),
+	}
+}
 
-			if s.icingaClient.GetClientConfig().URL != s.config.IcingaConfig.URL[0] {
-				// If the first URL is accessible, switch to the 'first one', it's the Icinga-Config-Master per default
-				oldUrl := s.icingaClient.GetClientConfig().URL
+// shutdownHeartbeat marks the heartbeat as WARNING, so Icinga shows that the
+// instance is shutting down rather than failed
+func (s *ServeCommand) shutdownHeartbeat(ts time.Time) error {
+	icinga := s.GetIcingaClient()
+	config := s.GetConfig()
+	svc, err := icinga.GetService(fmt.Sprintf("%v!heartbeat", config.HostName))
+	if err != nil {
+		return err
+	}
+	action := icinga2.Action{
+		ExitStatus:     1,
+		PluginOutput:   fmt.Sprintf("WARNING: %v: Signalilo is shutting down", ts.Format(time.RFC3339)),
+		CheckSource:    config.CheckSource,
+		ExecutionStart: webhook.IcingaTimestamp(ts),
+		ExecutionEnd:   webhook.IcingaTimestamp(ts),
+	}
+	err = icinga.ProcessCheckResult(svc, action)
+	s.recordCheckResult(context.Background(), audit.TriggerHeartbeat, svc, action, err)
+	return err
+}
 
-				s.icingaClient.SetIcingaUrl(s.config.IcingaConfig.URL[0])
+// recordCheckResult records a check result submitted to svc in the audit
+// log
+func (s *ServeCommand) recordCheckResult(ctx context.Context, trigger string, svc icinga2.Service, action icinga2.Action, err error) {
+	exitStatus := action.ExitStatus
+	s.recordAudit(ctx, audit.Event{
+		Action:       audit.ActionCheckResult,
+		Trigger:      trigger,
+		Service:      svc.FullName(),
+		ExitStatus:   &exitStatus,
+		PluginOutput: action.PluginOutput,
+		Error:        audit.ErrorMessage(err),
+	})
+}
 
-				erro := s.icingaClient.TestIcingaApi()
+// recordAudit records event in the audit log. Errors are only logged.
+func (s *ServeCommand) recordAudit(ctx context.Context, event audit.Event) {
+	if err := s.GetAuditLog().Record(ctx, event); err != nil {
+		s.GetLogger().Errorf("Unable to write audit log: %v", err)
+	}
+}
 
-				if erro != nil {
-					s.icingaClient.SetIcingaUrl(oldUrl)
-					continue
-				} else {
-					s.logger.Infof("Connecting to Icinga-Config-Master: %v", s.config.IcingaConfig.URL[0])
+// runTicker calls tick for each tick of ticker until ctx is done. The
+// ticker is stopped when runTicker returns.
+func (s *ServeCommand) runTicker(ctx context.Context, ticker *time.Ticker, tick func(ts time.Time)) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ts := <-ticker.C:
+				tick(ts)
+			}
+		}
+	}()
+}
+
+func (s *ServeCommand) startHeartbeat(ctx context.Context) error {
+	hbInterval := s.GetConfig().HeartbeatInterval
+	s.heartbeatTicker = time.NewTicker(hbInterval)
+	s.logger.Infof("Starting heartbeat: interval %v", hbInterval)
+
+	// All heartbeats are sent from the same goroutine, as each one
+	// reports the error rate since the previous one. Without leader
+	// election, leaderAcquired is nil and never ready.
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer s.heartbeatTicker.Stop()
+		// Send initial heartbeat from goroutine to make server
+		// startup quicker. With leader election, the lease isn't
+		// acquired yet, so the heartbeat is sent when it is.
+		if s.elector == nil {
+			s.sendHeartbeat(time.Now())
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.leaderAcquired:
+				if s.isLeader() {
+					s.sendHeartbeat(time.Now())
+				}
+			case ts := <-s.heartbeatTicker.C:
+				if !s.isLeader() {
+					s.logger.V(1).Infof("Not the leader, skipping heartbeat")
 					continue
 				}
+				s.sendHeartbeat(ts)
 			}
 		}
 	}()
 	return nil
 }
 
-func (s *ServeCommand) startServiceGC() error {
+// sendHeartbeat sends a heartbeat and logs errors
+func (s *ServeCommand) sendHeartbeat(ts time.Time) {
+	if err := s.heartbeat(ts); err != nil {
+		s.logger.Errorf("sending heartbeat: %s", err)
+	}
+}
+
+// startEndpointHealthChecks starts health checking the configured Icinga API
+// endpoints, if the Icinga client supports it
+func (s *ServeCommand) startEndpointHealthChecks(ctx context.Context) {
+	if manager, ok := s.GetIcingaClient().(*endpoint.Manager); ok {
+		s.logger.Infof("Starting Icinga API health checks: interval %v", s.GetConfig().IcingaConfig.HealthCheckInterval)
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			manager.Run(ctx)
+		}()
+	}
+}
+
+func (s *ServeCommand) startServiceGC(ctx context.Context) error {
 	gcInterval := s.GetConfig().GcInterval
 	s.gcTicker = time.NewTicker(gcInterval)
 	s.logger.Infof("Starting service garbage collector: interval %v", gcInterval)
-	go func() {
-		for ts := range s.gcTicker.C {
-			if err := gc.Collect(ts, s); err != nil {
-				s.logger.Error(err)
-			}
+	s.runTicker(ctx, s.gcTicker, func(ts time.Time) {
+		if !s.isLeader() {
+			s.logger.V(1).Infof("Not the leader, skipping garbage collection")
+			return
 		}
-	}()
+		report, err := gc.Run(ctx, ts, s, false)
+		if err != nil {
+			s.logger.Error(err)
+		}
+		s.stats.GCCompleted(ts, report.Summary(), err)
+	})
 	return nil
 }
 
-func (s *ServeCommand) run(ctx *kingpin.ParseContext) error {
-	http.HandleFunc("/healthz",
+// shutdown stops accepting new requests, and waits for in-flight webhook
+// requests and running background tasks to complete, or until the shutdown
+// timeout has elapsed. The background tasks must have been told to stop
+// before calling shutdown.
+func (s *ServeCommand) shutdown(server *http.Server) {
+	timeout := s.GetConfig().ShutdownTimeout
+	s.logger.Infof("Shutting down: waiting up to %v for in-flight requests", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		s.logger.Errorf("Not all in-flight requests completed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Errorf("Not all background tasks completed: %v", ctx.Err())
+	}
+
+	// With leader election, another instance takes over the heartbeat
+	if s.GetConfig().HeartbeatOnShutdown && s.elector == nil {
+		if err := s.shutdownHeartbeat(time.Now()); err != nil {
+			s.logger.Errorf("Unable to send shutdown heartbeat: %v", err)
+		}
+	}
+	s.logger.Infof("Shutdown complete")
+}
+
+func (s *ServeCommand) run(pc *kingpin.ParseContext) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz",
 		func(w http.ResponseWriter, r *http.Request) { healthz(w, r, s) })
-	http.HandleFunc("/webhook",
+	mux.HandleFunc("/readyz",
+		func(w http.ResponseWriter, r *http.Request) { readyz(w, r, s) })
+	mux.HandleFunc("/webhook",
 		func(w http.ResponseWriter, r *http.Request) { webhook.Webhook(w, r, s) })
-
+	mux.HandleFunc("/webhook/grafana",
+		func(w http.ResponseWriter, r *http.Request) { webhook.GrafanaWebhook(w, r, s) })
+	mux.HandleFunc(webhook.IngestPath,
+		func(w http.ResponseWriter, r *http.Request) { webhook.IngestWebhook(w, r, s, s.ingestConfig.Sources) })
+	mux.HandleFunc("/webhook/cloudevents",
+		func(w http.ResponseWriter, r *http.Request) { webhook.CloudEventsWebhook(w, r, s, s.ingestConfig) })
+	mux.HandleFunc("/admin/gc",
+		func(w http.ResponseWriter, r *http.Request) { adminGC(w, r, s, s.isLeader) })
+	mux.HandleFunc("/status",
+		func(w http.ResponseWriter, r *http.Request) { status(w, r, s) })
+	servicesHandler := func(w http.ResponseWriter, r *http.Request) { adminServices(w, r, s) }
+	mux.HandleFunc(servicesPath, servicesHandler)
+	mux.HandleFunc(servicesPath+"/", servicesHandler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s.startTime = time.Now()
+	if s.GetIcingaClient() == nil {
+		return fmt.Errorf("unable to create Icinga API client, see log for details")
+	}
+	shutdownTracing, err := s.startTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+	defer s.GetAuditLog().Close()
 	s.logger.Infof("Signalilo UUID: %v", s.GetConfig().UUID)
 	s.logger.Infof("Keep for: %v", s.GetConfig().KeepFor)
 	s.logger.Infof("Icinga API: %s", s.GetIcingaClient().GetClientConfig().URL)
 
-	if err := s.startHeartbeat(); err != nil {
+	s.ingestConfig = &ingest.Config{}
+	if s.GetConfig().IngestConfigPath != "" {
+		if s.ingestConfig, err = ingest.Load(s.GetConfig().IngestConfigPath); err != nil {
+			return err
+		}
+		s.logger.Infof("Ingestion sources: %v, CloudEvents rules: %v",
+			ingest.Names(s.ingestConfig.Sources), len(s.ingestConfig.CloudEvents))
+	}
+
+	s.startEndpointHealthChecks(ctx)
+	if err := s.startLeaderElection(ctx); err != nil {
+		return err
+	}
+	if err := s.startHeartbeat(ctx); err != nil {
 		return err
 	}
-	if err := s.startServiceGC(); err != nil {
+	if err := s.startServiceGC(ctx); err != nil {
+		return err
+	}
+	if err := s.startWatchdog(ctx); err != nil {
 		return err
 	}
 
 	listenAddress := fmt.Sprintf(":%d", s.port)
+	server := &http.Server{Addr: listenAddress, Handler: mux}
+	serveErr := make(chan error, 1)
 	s.logger.Infof("listening on: %v", listenAddress)
 	alertManagerConfig := s.config.AlertManagerConfig
-	if alertManagerConfig.UseTLS {
-		s.logger.Infof("Using TLS: certificate=%v, key=%v", alertManagerConfig.TLSCertPath, alertManagerConfig.TLSKeyPath)
-		return http.ListenAndServeTLS(listenAddress, alertManagerConfig.TLSCertPath, alertManagerConfig.TLSKeyPath, nil)
-	}
+	go func() {
+		if alertManagerConfig.UseTLS {
+			s.logger.Infof("Using TLS: certificate=%v, key=%v", alertManagerConfig.TLSCertPath, alertManagerConfig.TLSKeyPath)
+			serveErr <- server.ListenAndServeTLS(alertManagerConfig.TLSCertPath, alertManagerConfig.TLSKeyPath)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
 
-	return http.ListenAndServe(listenAddress, nil)
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		s.logger.Infof("Received shutdown signal")
+	}
+	s.shutdown(server)
+	return nil
 }
 
 func (s *ServeCommand) initialize(ctx *kingpin.ParseContext) error {
-	s.logger = config.NewLogger(s.logLevel)
-	config.ConfigInitialize(s)
-	return nil
+	// Other commands print JSON reports to stdout, so only serve prints
+	// the banner
+	fmt.Printf("Signalilo %v\n", Version)
+	fmt.Printf("Build time: %v\n\n", BuildDate)
+	s.logger = config.NewLogger(s.logLevel, s.config.LogFormat, s.config.LogOutput)
+	return config.ConfigInitialize(s)
 }
 
 func configureServeCommand(app *kingpin.Application) {
@@ -210,44 +476,100 @@ func configureServeCommand(app *kingpin.Application) {
 		config: config.SignaliloConfig{
 			StaticServiceVars:    map[string]string{},
 			CustomSeverityLevels: map[string]string{},
+			WatchdogLabels:       map[string]string{},
 		},
+		stats: stats.New(),
 	}
 	serve := app.Command("serve", "Run the Signalilo service").Default().Action(s.run).PreAction(s.initialize)
 
-	// General configuration
-	serve.Flag("uuid", "Instance UUID").Envar("SIGNALILO_UUID").Required().StringVar(&s.config.UUID)
-	serve.Flag("loglevel", "Signalilo Loglevel").Envar("SIGNALILO_LOG_LEVEL").Default("2").IntVar(&s.config.LogLevel)
+	configureIcingaFlags(serve, &s.config)
+	configureGCFlags(serve, &s.config)
 
 	// Icinga2 client configuration
-	serve.Flag("icinga_hostname", "Icinga Servicehost Name").Envar("SIGNALILO_ICINGA_HOSTNAME").Required().StringVar(&s.config.HostName)
-	serve.Flag("icinga_url", "Icinga API URL (can be repeated)").Envar("SIGNALILO_ICINGA_URL").Required().StringsVar(&s.config.IcingaConfig.URL)
-	serve.Flag("icinga_username", "Icinga Username").Envar("SIGNALILO_ICINGA_USERNAME").Required().StringVar(&s.config.IcingaConfig.User)
-	serve.Flag("icinga_password", "Icinga Password").Envar("SIGNALILO_ICINGA_PASSWORD").Required().StringVar(&s.config.IcingaConfig.Password)
-	serve.Flag("icinga_insecure_tls", "Skip Icinga TLS verification").Envar("SIGNALILO_ICINGA_INSECURE_TLS").Default("false").BoolVar(&s.config.IcingaConfig.InsecureTLS)
-	serve.Flag("icinga_x509_verify_cn", "Use CN when verifying certificates. Overrides the default go1.15 behavior of rejecting certificates without matching SAN.").Envar("SIGNALILO_ICINGA_X509_VERIFY_CN").Default("true").BoolVar(&s.config.IcingaConfig.X509VerifyCN)
-	serve.Flag("icinga_disable_keepalives", "Disable HTTP keepalives").Envar("SIGNALILO_ICINGA_DISABLE_KEEPALIVES").Default("false").BoolVar(&s.config.IcingaConfig.DisableKeepAlives)
 	serve.Flag("icinga_display_name_as_service_name", "Leave display name as service name").Envar("SIGNALILO_ICINGA_DISPLAY_NAME_AS_SERVICE_NAME").Default("false").BoolVar(&s.config.DisplayNameAsServiceName)
-	serve.Flag("icinga_debug", "Enable debug-level logging for icinga2 client library").Envar("SIGNALILO_ICINGA_DEBUG").Default("false").BoolVar(&s.config.IcingaConfig.Debug)
 	serve.Flag("icinga_heartbeat_interval", "Heartbeat interval to Icinga").Envar("SIGNALILO_ICINGA_HEARTBEAT_INTERVAL").Default("1m").DurationVar(&s.config.HeartbeatInterval)
+	serve.Flag("icinga_heartbeat_error_rate_threshold", "Report the heartbeat as WARNING if the fraction of alerts which couldn't be delivered since the last heartbeat exceeds this value").Envar("SIGNALILO_ICINGA_HEARTBEAT_ERROR_RATE_THRESHOLD").Default("0.1").Float64Var(&s.config.HeartbeatErrorRateThreshold)
+	serve.Flag("icinga_heartbeat_backlog_threshold", "Report the heartbeat as WARNING if more than this number of webhook requests are in flight").Envar("SIGNALILO_ICINGA_HEARTBEAT_BACKLOG_THRESHOLD").Default("10").IntVar(&s.config.HeartbeatBacklogThreshold)
 	serve.Flag("icinga_gc_interval", "Garbage collection interval for old alerts").Envar("SIGNALILO_ICINGA_GC_INTERVAL").Default("15m").DurationVar(&s.config.GcInterval)
 	serve.Flag("icinga_keep_for", "How long to keep old alerts around after they've been resolved").Envar("SIGNALILO_ICINGA_KEEP_FOR").Default("168h").DurationVar(&s.config.KeepFor)
-	serve.Flag("icinga_ca", "A custom CA certificate to use when connecting to the Icinga API").Envar("SIGNALILO_ICINGA_CA").StringVar(&s.config.CAData)
+	serve.Flag("icinga_keep_for_policy", "Keep alerts whose label has the given value for the given duration after they've been resolved. The expected format is label=value:duration. The first matching policy is used. Can be repeated.").Envar("SIGNALILO_ICINGA_KEEP_FOR_POLICY").StringsVar(&s.config.KeepForPolicyRules)
 	serve.Flag("icinga_service_template", "Create icinga services with the given template (can be repeated). The default is \"generic-service\"").Envar("SIGNALILO_ICINGA_SERVICE_TEMPLATE").Default("generic-service").StringsVar(&s.config.IcingaConfig.Templates)
 	serve.Flag("icinga_service_checks_active", "Create icinga services as active checks").Envar("SIGNALILO_ICINGA_SERVICE_CHECKS_ACTIVE").Default("false").BoolVar(&s.config.ActiveChecks)
 	serve.Flag("icinga_service_checks_command", "Specify icinga check command during service creation").Envar("SIGNALILO_ICINGA_SERVICE_CHECKS_COMMAND").Default("dummy").StringVar(&s.config.CheckCommand)
 	serve.Flag("icinga_service_checks_interval", "Interval (in seconds) to be used for icinga check_interval and retry_interval").Envar("SIGNALILO_ICINGA_SERVICE_CHECKS_INTERVAL").Default("12h").DurationVar(&s.config.ChecksInterval)
 	serve.Flag("icinga_service_max_check_attempts", "The maximum number of checks which are executed before changing to a hard state").Envar("SIGNALILO_ICINGA_SERVICE_MAX_CHECK_ATTEMPTS").Default("1").IntVar(&s.config.MaxCheckAttempts)
 	serve.Flag("icinga_static_service_var", "A variable to be set on each Icinga service created by Signalilo. The expected format is variable=value. Can be repeated.").Envar("SIGNALILO_ICINGA_STATIC_SERVICE_VAR").StringMapVar(&s.config.StaticServiceVars)
-	serve.Flag("icinga_reconnect", "If it's set, Signalilo to waits for a reconnect instead of switching immediately to another URL.").Envar("SIGNALILO_ICINGA_RECONNECT").Default("0").DurationVar(&s.config.Reconnect)
+	serve.Flag("icinga_dedup_check_results", "Don't submit check results whose state and plugin output are unchanged since the last submission for the service").Envar("SIGNALILO_ICINGA_DEDUP_CHECK_RESULTS").Default("false").BoolVar(&s.config.DedupCheckResults)
+	serve.Flag("icinga_dedup_refresh_interval", "Resubmit unchanged check results once this interval has elapsed since the last submission. 0 never resubmits unchanged check results, which isn't allowed with active checks").Envar("SIGNALILO_ICINGA_DEDUP_REFRESH_INTERVAL").Default("0").DurationVar(&s.config.DedupRefreshInterval)
+	serve.Flag("icinga_check_source", "Check source reported for check results. Defaults to the instance UUID").Envar("SIGNALILO_ICINGA_CHECK_SOURCE").StringVar(&s.config.CheckSource)
+
+	// Webhook watchdog configuration
+	serve.Flag("watchdog_window", "Set the watchdog service to CRITICAL if no webhook (or watchdog alert, if watchdog labels are configured) has been received within this window. 0 disables the watchdog").Envar("SIGNALILO_WATCHDOG_WINDOW").Default("0").DurationVar(&s.config.WatchdogWindow)
+	serve.Flag("watchdog_label", "A label which identifies the watchdog alert. The expected format is label=value. Can be repeated.").Envar("SIGNALILO_WATCHDOG_LABEL").StringMapVar(&s.config.WatchdogLabels)
+	serve.Flag("watchdog_service_name", "Name of the Icinga service which reflects the watchdog state").Envar("SIGNALILO_WATCHDOG_SERVICE_NAME").Default("webhook_watchdog").StringVar(&s.config.WatchdogServiceName)
+
+	serve.Flag("shutdown_timeout", "How long to wait for in-flight webhook requests and background tasks on shutdown").Envar("SIGNALILO_SHUTDOWN_TIMEOUT").Default("30s").DurationVar(&s.config.ShutdownTimeout)
+	serve.Flag("icinga_heartbeat_on_shutdown", "Mark the heartbeat as WARNING when shutting down").Envar("SIGNALILO_ICINGA_HEARTBEAT_ON_SHUTDOWN").Default("false").BoolVar(&s.config.HeartbeatOnShutdown)
+
+	serve.Flag("admin_bearer_token", "Bearer token for the admin endpoints. The admin endpoints are disabled if no token is set").Envar("SIGNALILO_ADMIN_BEARER_TOKEN").StringVar(&s.config.AdminBearerToken)
+	serve.Flag("status_public", "Serve the read-only status page, whose secrets are redacted, without the admin bearer token").Envar("SIGNALILO_STATUS_PUBLIC").Default("false").BoolVar(&s.config.StatusPublic)
+
+	// Leader election configuration
+	serve.Flag("leader_election", "Leader election mode: none, kubernetes or file. Only the leader sends heartbeats, runs the garbage collector and updates the watchdog").Envar("SIGNALILO_LEADER_ELECTION").Default(leaderElectionNone).EnumVar(&s.config.LeaderElection.Mode, leaderElectionNone, leaderElectionKubernetes, leaderElectionFile)
+	serve.Flag("leader_election_lease_name", "Name of the Kubernetes Lease object used for leader election").Envar("SIGNALILO_LEADER_ELECTION_LEASE_NAME").Default("signalilo").StringVar(&s.config.LeaderElection.LeaseName)
+	serve.Flag("leader_election_namespace", "Namespace of the Kubernetes Lease object. Defaults to the namespace of the pod").Envar("SIGNALILO_LEADER_ELECTION_NAMESPACE").StringVar(&s.config.LeaderElection.Namespace)
+	serve.Flag("leader_election_lock_file", "Path of the lease file on a filesystem shared by all replicas, for leader election mode file").Envar("SIGNALILO_LEADER_ELECTION_LOCK_FILE").StringVar(&s.config.LeaderElection.LockFile)
+	serve.Flag("leader_election_identity", "Identity of this instance in the leader election. Defaults to the hostname").Envar("SIGNALILO_LEADER_ELECTION_IDENTITY").StringVar(&s.config.LeaderElection.Identity)
+	serve.Flag("leader_election_lease_duration", "How long the leader lease is valid without being renewed").Envar("SIGNALILO_LEADER_ELECTION_LEASE_DURATION").Default("15s").DurationVar(&s.config.LeaderElection.LeaseDuration)
+
+	// Tracing configuration
+	serve.Flag("otlp_endpoint", "Host and port of the OTLP/HTTP receiver to which traces are exported, e.g. otel-collector:4318. Tracing is disabled if not set").Envar("SIGNALILO_OTLP_ENDPOINT").StringVar(&s.config.Tracing.OTLPEndpoint)
+	serve.Flag("otlp_insecure", "Export traces without TLS").Envar("SIGNALILO_OTLP_INSECURE").Default("false").BoolVar(&s.config.Tracing.OTLPInsecure)
+	serve.Flag("tracing_sample_ratio", "Fraction of webhook requests and background tasks which are traced, unless the incoming request carries a sampled trace context").Envar("SIGNALILO_TRACING_SAMPLE_RATIO").Default("1").Float64Var(&s.config.Tracing.SampleRatio)
 
 	// Alert manager configuration
 	serve.Flag("alertmanager_port", "Listening port for the Alertmanager webhook").Default("8888").Envar("SIGNALILO_ALERTMANAGER_PORT").IntVar(&s.port)
 	serve.Flag("alertmanager_bearer_token", "Bearer token for incoming requests").Envar("SIGNALILO_ALERTMANAGER_BEARER_TOKEN").Required().StringVar(&s.config.AlertManagerConfig.BearerToken)
 	serve.Flag("alertmanager_tls_cert", "Path of certificate file for TLS-enabled webhook endpoint. Should contain the full chain").Envar("SIGNALILO_ALERTMANAGER_TLS_CERT").StringVar(&s.config.AlertManagerConfig.TLSCertPath)
 	serve.Flag("alertmanager_tls_key", "Path of private key file for TLS-enabled webhook endpoint").Envar("SIGNALILO_ALERTMANAGER_TLS_KEY").StringVar(&s.config.AlertManagerConfig.TLSKeyPath)
+	serve.Flag("alertmanager_max_body_size", "Maximum size in bytes of incoming webhook requests. 0 disables the limit").Envar("SIGNALILO_ALERTMANAGER_MAX_BODY_SIZE").Default("10485760").Int64Var(&s.config.AlertManagerConfig.MaxBodySize)
+	serve.Flag("alertmanager_api_url", "URL of the Alertmanager API, from which alerts truncated from webhook requests are fetched").Envar("SIGNALILO_ALERTMANAGER_API_URL").StringVar(&s.config.AlertManagerConfig.APIURL)
+	serve.Flag("alertmanager_api_bearer_token", "Bearer token for requests to the Alertmanager API").Envar("SIGNALILO_ALERTMANAGER_API_BEARER_TOKEN").StringVar(&s.config.AlertManagerConfig.APIBearerToken)
+	serve.Flag("alertmanager_max_alerts", "Maximum number of alerts in a single webhook request. 0 disables the limit").Envar("SIGNALILO_ALERTMANAGER_MAX_ALERTS").Default("0").IntVar(&s.config.AlertManagerConfig.MaxAlerts)
+	serve.Flag("ingest_config", "Path of the YAML file which configures the sources of the generic JSON ingestion endpoint and the CloudEvents rules").Envar("SIGNALILO_INGEST_CONFIG").StringVar(&s.config.IngestConfigPath)
 
 	serve.Flag("alertmanager_pluginoutput_annotations", "List of Annotation names to be used to set the Plugin Output for the Icinga Service").Default("message").Envar("SIGNALILO_ALERTMANAGER_PLUGINOUTPUT_ANNOTATIONS").StringsVar(&s.config.AlertManagerConfig.PluginOutputAnnotations)
 	serve.Flag("alertmanager_custom_severity_levels", "Add or override the default mapping of Severity Levels to Service States. The expected format is Severity_Level=Service_State where the Service_State is 0=OK, 1=Warning, 2=Critical, 3=Unknown. Can be repeated.").Envar("SIGNALILO_ALERTMANAGER_CUSTOM_SEVERITY_LEVELS").StringMapVar(&s.config.CustomSeverityLevels)
+	serve.Flag("alertmanager_perfdata_annotations", "Annotation name to be rendered as performance data of the check result (can be repeated). Annotations prefixed with icinga_perfdata_ are always used").Envar("SIGNALILO_ALERTMANAGER_PERFDATA_ANNOTATIONS").StringsVar(&s.config.AlertManagerConfig.PerfDataAnnotations)
+	serve.Flag("alertmanager_perfdata_labels", "Label name to be rendered as performance data of the check result (can be repeated). Labels prefixed with icinga_perfdata_ are always used").Envar("SIGNALILO_ALERTMANAGER_PERFDATA_LABELS").StringsVar(&s.config.AlertManagerConfig.PerfDataLabels)
+	serve.Flag("alertmanager_longoutput_annotations", "List of Annotation names to be added to the long output of the check result").Envar("SIGNALILO_ALERTMANAGER_LONGOUTPUT_ANNOTATIONS").StringsVar(&s.config.AlertManagerConfig.LongOutputAnnotations)
+	serve.Flag("alertmanager_longoutput_labels", "Add all labels of the alert to the long output of the check result").Default("false").Envar("SIGNALILO_ALERTMANAGER_LONGOUTPUT_LABELS").BoolVar(&s.config.AlertManagerConfig.LongOutputLabels)
 	serve.Flag("alertmanager_pluginoutput_by_states", "Enables support for dynamically selecting the Annotation name used for the Plugin Output based on the computed Service State.").Default("false").Envar("SIGNALILO_ALERTMANAGER_PLUGINOUTPUT_BY_STATES").BoolVar(&s.config.AlertManagerConfig.PluginOutputByStates)
 
 }
+
+// startTracing sets up exporting traces, if an OTLP endpoint is configured.
+// The returned function flushes the remaining spans.
+func (s *ServeCommand) startTracing(ctx context.Context) (func(), error) {
+	cfg := s.GetConfig().Tracing
+	shutdown, err := tracing.Setup(ctx, tracing.Options{
+		Endpoint:    cfg.OTLPEndpoint,
+		Insecure:    cfg.OTLPInsecure,
+		SampleRatio: cfg.SampleRatio,
+		InstanceID:  s.GetConfig().UUID,
+		Version:     Version,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("setting up tracing: %w", err)
+	}
+	if cfg.OTLPEndpoint != "" {
+		s.logger.Infof("Exporting traces to %v, sample ratio %v", cfg.OTLPEndpoint, cfg.SampleRatio)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			s.logger.Errorf("Unable to flush traces: %v", err)
+		}
+	}, nil
+}
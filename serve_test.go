@@ -10,10 +10,17 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
-	"github.com/vshn/signalilo/config"
+	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/stats"
 )
 
 func TestHealthz(t *testing.T) {
@@ -30,3 +37,104 @@ func TestHealthz(t *testing.T) {
 
 	assert.HTTPBodyContains(handler, "GET", "http://example.com/healthz", nil, "ok")
 }
+
+func TestHeartbeatResult(t *testing.T) {
+	s := &ServeCommand{}
+	s.config.IcingaConfig.URL = []string{"https://master:5665", "https://satellite:5665"}
+	s.config.HeartbeatErrorRateThreshold = 0.1
+	s.config.HeartbeatBacklogThreshold = 10
+	s.config.CheckSource = "signalilo-0"
+
+	assert := assert.New(t)
+	ts := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	prev := stats.Snapshot{AlertsProcessed: 10, Errors: 1}
+	current := stats.Snapshot{AlertsProcessed: 30, Errors: 2, InFlight: 1, LastWebhook: ts.Add(-30 * time.Second)}
+	action := s.heartbeatResult(ts, current, prev, "https://master:5665")
+	assert.Equal(0, action.ExitStatus)
+	assert.Equal("OK: 2020-01-01T12:00:00Z", action.PluginOutput)
+	assert.Equal("signalilo-0", action.CheckSource)
+	assert.Equal(icinga2.PerfData{
+		"alerts_processed=30c",
+		"errors=2c",
+		"in_flight=1",
+		"alerts_truncated=0c",
+		"alerts_recovered=0c",
+		"gc_malformed=0",
+		"last_webhook_age=30s",
+	}, action.PerformanceData)
+
+	current = stats.Snapshot{AlertsProcessed: 20, Errors: 6, InFlight: 11, GCError: fmt.Errorf("timeout"), GC: stats.GCSummary{Malformed: 2}}
+	action = s.heartbeatResult(ts, current, prev, "https://satellite:5665")
+	assert.Equal(1, action.ExitStatus)
+	assert.Equal("WARNING: 2020-01-01T12:00:00Z: 5 of 10 alerts not delivered since last heartbeat; "+
+		"11 webhook requests in flight; failed over to Icinga API https://satellite:5665; "+
+		"garbage collection failing: timeout; 2 managed services with malformed variables, see garbage collection log", action.PluginOutput)
+	assert.Len(action.PerformanceData, 6, "no last_webhook_age without webhook")
+	assert.Contains(action.PerformanceData, "gc_malformed=2")
+
+	prev = stats.Snapshot{AlertsTruncated: 5, AlertsRecovered: 5}
+	current = stats.Snapshot{AlertsTruncated: 15, AlertsRecovered: 8}
+	action = s.heartbeatResult(ts, current, prev, "https://master:5665")
+	assert.Equal(1, action.ExitStatus)
+	assert.Equal("WARNING: 2020-01-01T12:00:00Z: 7 alerts truncated by Alertmanager since last heartbeat", action.PluginOutput)
+	assert.Contains(action.PerformanceData, "alerts_truncated=15c")
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s := &ServeCommand{stats: stats.New()}
+	s.logger = config.MockLogger(1)
+	s.config.HostName = "signalilo_test"
+	s.config.ShutdownTimeout = 5 * time.Second
+	s.config.HeartbeatOnShutdown = true
+	icinga := icinga2.NewMockClient()
+	icinga.Services["signalilo_test!heartbeat"] = icinga2.Service{Name: "heartbeat", HostName: "signalilo_test"}
+	s.icingaClient = icinga
+
+	// a background task which must be stopped before shutdown completes
+	ctx, stop := context.WithCancel(context.Background())
+	s.runTicker(ctx, time.NewTicker(time.Millisecond), func(ts time.Time) {})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+	defer server.Close()
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+
+	stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		s.shutdown(server.Config)
+		close(shutdownDone)
+	}()
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown completed before in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-shutdownDone
+
+	assert.Equal(t, http.StatusOK, <-responses, "in-flight request completed")
+	actions := icinga.Actions["signalilo_test!heartbeat"]
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, 1, actions[0].ExitStatus)
+		assert.Contains(t, actions[0].PluginOutput, "shutting down")
+	}
+}
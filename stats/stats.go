@@ -0,0 +1,180 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats collects counters and timestamps about the operation of a Signalilo
+// instance. Stats is safe for concurrent use.
+type Stats struct {
+	mutex    sync.Mutex
+	data     Snapshot
+	webhooks []WebhookRequest
+}
+
+// maxRecentWebhooks is the number of webhook requests kept by Stats
+const maxRecentWebhooks = 20
+
+// WebhookRequest describes a webhook request which has been handled
+type WebhookRequest struct {
+	Timestamp time.Time     `json:"timestamp"`
+	RequestID string        `json:"request_id"`
+	Status    int           `json:"status"`
+	Alerts    int           `json:"alerts"`
+	Failed    int           `json:"failed"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// GCSummary summarizes a garbage collection run
+type GCSummary struct {
+	Deleted   int `json:"deleted"`
+	Kept      int `json:"kept"`
+	Errors    int `json:"errors"`
+	Malformed int `json:"malformed"`
+	Adopted   int `json:"adopted"`
+}
+
+// Snapshot is a point-in-time copy of the values collected in Stats
+type Snapshot struct {
+	// AlertsProcessed is the number of alerts received through webhooks
+	AlertsProcessed uint64
+	// Errors is the number of alerts which couldn't be delivered to Icinga
+	Errors uint64
+	// AlertsTruncated is the number of alerts which Alertmanager dropped
+	// from webhook requests because of the max_alerts limit
+	AlertsTruncated uint64
+	// AlertsRecovered is the number of truncated alerts which have been
+	// fetched from the Alertmanager API
+	AlertsRecovered uint64
+	// InFlight is the number of webhook requests currently being handled
+	InFlight int
+	// LastWebhook is the time at which the last webhook request was received
+	LastWebhook time.Time
+	// LastWatchdogAlert is the time at which the last firing watchdog
+	// alert was received
+	LastWatchdogAlert time.Time
+	// LastHeartbeat is the time at which the last heartbeat was
+	// successfully submitted to Icinga
+	LastHeartbeat time.Time
+	// LastGC is the time at which the last garbage collection run started
+	LastGC time.Time
+	// GCError is the error returned by the last garbage collection run
+	GCError error
+	// GC summarizes the last garbage collection run
+	GC GCSummary
+	// Standby is true if leader election is enabled and this instance
+	// isn't the leader
+	Standby bool
+}
+
+// New creates an empty Stats object
+func New() *Stats {
+	return &Stats{}
+}
+
+// WebhookStarted records that a webhook request has been received at ts
+func (s *Stats) WebhookStarted(ts time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.InFlight++
+	s.data.LastWebhook = ts
+}
+
+// WebhookFinished records that handling a webhook request has completed
+func (s *Stats) WebhookFinished() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.InFlight--
+}
+
+// WebhookHandled records the outcome of a webhook request. Only the most
+// recent requests are kept.
+func (s *Stats) WebhookHandled(req WebhookRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.webhooks = append(s.webhooks, req)
+	if len(s.webhooks) > maxRecentWebhooks {
+		s.webhooks = s.webhooks[len(s.webhooks)-maxRecentWebhooks:]
+	}
+}
+
+// RecentWebhooks returns the most recent webhook requests, newest first
+func (s *Stats) RecentWebhooks() []WebhookRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	recent := make([]WebhookRequest, 0, len(s.webhooks))
+	for i := len(s.webhooks) - 1; i >= 0; i-- {
+		recent = append(recent, s.webhooks[i])
+	}
+	return recent
+}
+
+// WatchdogAlertReceived records that a firing watchdog alert has been
+// received at ts
+func (s *Stats) WatchdogAlertReceived(ts time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.LastWatchdogAlert = ts
+}
+
+// AlertProcessed records that an alert has been processed. failed indicates
+// whether delivering the alert to Icinga failed.
+func (s *Stats) AlertProcessed(failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.AlertsProcessed++
+	if failed {
+		s.data.Errors++
+	}
+}
+
+// AlertsTruncated records that Alertmanager dropped truncated alerts from
+// a webhook request, of which recovered alerts have been fetched from the
+// Alertmanager API
+func (s *Stats) AlertsTruncated(truncated, recovered int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.AlertsTruncated += uint64(truncated)
+	s.data.AlertsRecovered += uint64(recovered)
+}
+
+// HeartbeatSent records that a heartbeat has been submitted to Icinga at ts
+func (s *Stats) HeartbeatSent(ts time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.LastHeartbeat = ts
+}
+
+// GCCompleted records the result of a garbage collection run started at ts
+func (s *Stats) GCCompleted(ts time.Time, summary GCSummary, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.LastGC = ts
+	s.data.GC = summary
+	s.data.GCError = err
+}
+
+// LeadershipChanged records whether this instance is the leader
+func (s *Stats) LeadershipChanged(leader bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Standby = !leader
+}
+
+// Snapshot returns a copy of the current values
+func (s *Stats) Snapshot() Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data
+}
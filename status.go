@@ -0,0 +1,156 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/stats"
+)
+
+//go:embed status.html
+var statusHTML string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusHTML))
+
+// endpointReporter is implemented by Icinga clients which fail over between
+// several Icinga API endpoints
+type endpointReporter interface {
+	Status() []endpoint.Status
+	History() []endpoint.Switch
+}
+
+// gcStatus describes the last garbage collection run
+type gcStatus struct {
+	LastRun time.Time       `json:"last_run"`
+	Summary stats.GCSummary `json:"summary"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// statusReport is shown on the status page
+type statusReport struct {
+	Timestamp         time.Time              `json:"timestamp"`
+	Version           string                 `json:"version"`
+	UUID              string                 `json:"uuid"`
+	Host              string                 `json:"host"`
+	Standby           bool                   `json:"standby"`
+	Readiness         readinessReport        `json:"readiness"`
+	ActiveEndpoint    string                 `json:"active_endpoint"`
+	Endpoints         []endpoint.Status      `json:"endpoints"`
+	Failovers         []endpoint.Switch      `json:"failovers"`
+	AlertsProcessed   uint64                 `json:"alerts_processed"`
+	Errors            uint64                 `json:"errors"`
+	AlertsTruncated   uint64                 `json:"alerts_truncated"`
+	AlertsRecovered   uint64                 `json:"alerts_recovered"`
+	InFlight          int                    `json:"in_flight"`
+	LastWebhook       time.Time              `json:"last_webhook"`
+	LastWatchdogAlert time.Time              `json:"last_watchdog_alert"`
+	LastHeartbeat     time.Time              `json:"last_heartbeat"`
+	GC                gcStatus               `json:"gc"`
+	Webhooks          []stats.WebhookRequest `json:"webhooks"`
+	Config            config.SignaliloConfig `json:"config"`
+}
+
+// collectStatus collects the status of the Signalilo instance at ts.
+// Secrets are redacted.
+func collectStatus(ts time.Time, c config.Configuration) statusReport {
+	cfg := c.GetConfig()
+	current := c.GetStats().Snapshot()
+	report := statusReport{
+		Timestamp:         ts,
+		Version:           Version,
+		UUID:              cfg.UUID,
+		Host:              cfg.HostName,
+		Standby:           current.Standby,
+		Readiness:         checkReadiness(ts, c),
+		Endpoints:         []endpoint.Status{},
+		Failovers:         []endpoint.Switch{},
+		AlertsProcessed:   current.AlertsProcessed,
+		Errors:            current.Errors,
+		AlertsTruncated:   current.AlertsTruncated,
+		AlertsRecovered:   current.AlertsRecovered,
+		InFlight:          current.InFlight,
+		LastWebhook:       current.LastWebhook,
+		LastWatchdogAlert: current.LastWatchdogAlert,
+		LastHeartbeat:     current.LastHeartbeat,
+		GC: gcStatus{
+			LastRun: current.LastGC,
+			Summary: current.GC,
+		},
+		Webhooks: c.GetStats().RecentWebhooks(),
+		Config:   cfg.Redacted(),
+	}
+	if current.GCError != nil {
+		report.GC.Error = current.GCError.Error()
+	}
+	icinga := c.GetIcingaClient()
+	if icinga != nil {
+		report.ActiveEndpoint = config.RedactURL(icinga.GetClientConfig().URL)
+	}
+	if reporter, ok := icinga.(endpointReporter); ok {
+		for _, s := range reporter.Status() {
+			s.URL = config.RedactURL(s.URL)
+			report.Endpoints = append(report.Endpoints, s)
+		}
+		for _, s := range reporter.History() {
+			s.From = config.RedactURL(s.From)
+			s.To = config.RedactURL(s.To)
+			report.Failovers = append(report.Failovers, s)
+		}
+	}
+	return report
+}
+
+// statusPage is rendered by the status template
+type statusPage struct {
+	statusReport
+	ConfigJSON string
+}
+
+// Ago formats ts relative to the time of the report
+func (p statusPage) Ago(ts time.Time) string {
+	if ts.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%v (%v ago)", ts.Format(time.RFC3339), p.Timestamp.Sub(ts).Round(time.Second))
+}
+
+// status serves the status page of the Signalilo instance. The status is
+// returned as JSON with query parameter format=json or if the client
+// accepts JSON, and as HTML page otherwise. The status page requires the
+// admin bearer token, unless it's public, so it can be opened in a browser.
+func status(w http.ResponseWriter, r *http.Request, c config.Configuration) {
+	if !c.GetConfig().StatusPublic && !checkAdminRequest(w, r, c) {
+		return
+	}
+	report := collectStatus(time.Now(), c)
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	cfg, err := json.MarshalIndent(report.Config, "", "  ")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, statusPage{report, string(cfg)}); err != nil {
+		c.GetLogger().Errorf("Rendering status page: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+// Package tracing sets up OpenTelemetry tracing and provides helpers to
+// trace webhook handling and Icinga API calls
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by Signalilo
+const instrumentationName = "github.com/vshn/signalilo"
+
+// Attribute keys shared by all spans
+const (
+	AttrRequestID   = attribute.Key("signalilo.request_id")
+	AttrFingerprint = attribute.Key("signalilo.alert.fingerprint")
+	AttrAlertStatus = attribute.Key("signalilo.alert.status")
+	AttrAlerts      = attribute.Key("signalilo.alerts")
+	AttrService     = attribute.Key("icinga.service")
+	AttrEndpoint    = attribute.Key("icinga.endpoint")
+	AttrOperation   = attribute.Key("icinga.operation")
+)
+
+// Options configure the export of traces
+type Options struct {
+	// Endpoint is the host and port of the OTLP/HTTP receiver. Tracing is
+	// disabled if Endpoint is empty.
+	Endpoint string
+	// Insecure disables TLS for the connection to the receiver
+	Insecure bool
+	// SampleRatio is the fraction of traces which are sampled, unless the
+	// parent span of an incoming request is sampled
+	SampleRatio float64
+	// InstanceID identifies the Signalilo instance
+	InstanceID string
+	// Version is the version of Signalilo
+	Version string
+}
+
+// Setup installs the global tracer provider, which exports spans through
+// OTLP/HTTP, and the W3C trace context propagator. The returned function
+// flushes the remaining spans and must be called on shutdown. If tracing is
+// disabled, only the propagator is installed.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceNameKey.String("signalilo"),
+		semconv.ServiceInstanceIDKey.String(opts.InstanceID),
+		semconv.ServiceVersionKey.String(opts.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Extract returns a context which carries the trace context of the
+// incoming request r
+func Extract(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// StartIcingaCall starts a span for the Icinga API call operation to
+// endpoint. Credentials in the endpoint URL aren't recorded.
+func StartIcingaCall(ctx context.Context, operation, endpoint string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if u, err := url.Parse(endpoint); err == nil {
+		endpoint = u.Redacted()
+	}
+	attrs = append(attrs, AttrOperation.String(operation), AttrEndpoint.String(endpoint))
+	return otel.Tracer(instrumentationName).Start(ctx, "icinga."+operation,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// Fail marks the operation traced by span as failed with err
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End records the outcome err of the operation traced by span and ends the
+// span
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
@@ -0,0 +1,229 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
+	"github.com/vshn/signalilo/endpoint"
+	"github.com/vshn/signalilo/stats"
+	"github.com/vshn/signalilo/webhook"
+)
+
+// watchdogService returns the Icinga service which reflects the webhook
+// watchdog state. The service is created if it doesn't exist yet.
+func (s *ServeCommand) watchdogService() (icinga2.Service, error) {
+	icinga := s.GetIcingaClient()
+	config := s.GetConfig()
+	l := s.GetLogger()
+
+	svc, err := icinga.GetService(fmt.Sprintf("%v!%v", config.HostName, config.WatchdogServiceName))
+	if err == nil {
+		return svc, nil
+	}
+
+	// The watchdog service doesn't carry our bridge UUID, so it's never
+	// garbage collected
+	svc = icinga2.Service{
+		Name:               config.WatchdogServiceName,
+		DisplayName:        "Signalilo webhook watchdog",
+		HostName:           config.HostName,
+		CheckCommand:       config.CheckCommand,
+		EnableActiveChecks: false,
+		Notes:              "CRITICAL if Signalilo hasn't received any webhook from Alertmanager for too long",
+		Vars:               icinga2.Vars{"signalilo_watchdog": true},
+		CheckInterval:      config.ChecksInterval.Seconds(),
+		RetryInterval:      config.ChecksInterval.Seconds(),
+		MaxCheckAttempts:   1,
+		Templates:          config.IcingaConfig.Templates,
+	}
+	l.Infof("watchdog: creating service %v", svc.Name)
+	err = icinga.CreateService(svc)
+	s.recordAudit(context.Background(), audit.Event{
+		Action:  audit.ActionServiceCreate,
+		Trigger: audit.TriggerWatchdog,
+		Service: svc.FullName(),
+		Changes: audit.Diff(icinga2.Service{}, svc),
+		Error:   audit.ErrorMessage(err),
+	})
+	if err != nil {
+		return icinga2.Service{}, err
+	}
+	return svc, nil
+}
+
+// Prefixes of the variables of the watchdog service which hold the last time
+// each replica received a webhook or a watchdog alert. The replica's
+// identity is appended, so replicas don't overwrite each other's time.
+const (
+	lastWebhookVar       = "signalilo_last_webhook"
+	lastWatchdogAlertVar = "signalilo_last_watchdog_alert"
+)
+
+// invalidVarChars matches the characters of an identity which aren't used in
+// variable names. Dots would be interpreted as nested variables by Icinga.
+var invalidVarChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// replicaVar returns the name of the variable with prefix key which holds
+// the time of the replica with the given identity
+func replicaVar(key, identity string) string {
+	return key + "_" + invalidVarChars.ReplaceAllString(identity, "_")
+}
+
+// latestReplicaTime returns the latest of last and the times shared by all
+// replicas in the variables with prefix key
+func latestReplicaTime(vars icinga2.Vars, key string, last time.Time) time.Time {
+	for name, value := range vars {
+		if !strings.HasPrefix(name, key+"_") {
+			continue
+		}
+		if shared, err := time.Parse(time.RFC3339Nano, fmt.Sprint(value)); err == nil && shared.After(last) {
+			last = shared
+		}
+	}
+	return last
+}
+
+// watchdog submits the webhook watchdog state to Icinga. With leader
+// election, webhooks are received by all replicas, so every replica which
+// isn't the leader shares the time when it last received what the watchdog
+// watches in its own variable of the watchdog service, and the leader
+// submits the state based on the latest of these times.
+func (s *ServeCommand) watchdog(ts time.Time) error {
+	l := s.GetLogger()
+
+	svc, err := s.watchdogService()
+	if err != nil {
+		l.Errorf("watchdog: unable to get watchdog service: %v", err)
+		return err
+	}
+
+	what, key, last := s.watchdogSubject(s.GetStats().Snapshot())
+	if s.elector != nil {
+		if !s.isLeader() {
+			s.shareWatchdogTime(svc, what, replicaVar(key, s.elector.Identity()), last)
+			return nil
+		}
+		last = latestReplicaTime(svc.Vars, key, last)
+	}
+
+	action := s.watchdogResult(ts, what, last)
+	l.V(1).Infof("Sending watchdog state: '%v'", action.PluginOutput)
+	err = s.GetIcingaClient().ProcessCheckResult(svc, action)
+	s.recordCheckResult(context.Background(), audit.TriggerWatchdog, svc, action, err)
+	if err != nil {
+		l.Errorf("watchdog: process_check_result: %v", err)
+		return err
+	}
+	return nil
+}
+
+// shareWatchdogTime stores last in the variable key of the watchdog service,
+// if it's newer than the stored time. The service is only updated if the
+// replica received something since it last shared its time.
+func (s *ServeCommand) shareWatchdogTime(svc icinga2.Service, what, key string, last time.Time) {
+	shared, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(svc.Vars[key]))
+	if !last.After(shared) {
+		return
+	}
+	l := s.GetLogger()
+	value := last.UTC().Format(time.RFC3339Nano)
+	l.V(1).Infof("watchdog: sharing last %v received at %v", what, value)
+	err := endpoint.UpdateServiceVars(s.GetIcingaClient(), svc.FullName(), icinga2.Vars{key: value})
+	s.recordAudit(context.Background(), audit.Event{
+		Action:  audit.ActionServiceUpdate,
+		Trigger: audit.TriggerWatchdog,
+		Service: svc.FullName(),
+		Changes: map[string]audit.Change{"vars." + key: {Old: svc.Vars[key], New: value}},
+		Error:   audit.ErrorMessage(err),
+	})
+	if err != nil {
+		l.Errorf("watchdog: unable to share last %v: %v", what, err)
+	}
+}
+
+// watchdogSubject returns a description of what the watchdog watches, the
+// watchdog service variable which holds the last time it was received, and
+// the last time this instance received it. The watchdog watches webhooks,
+// or firing watchdog alerts if watchdog labels are configured.
+func (s *ServeCommand) watchdogSubject(current stats.Snapshot) (what, key string, last time.Time) {
+	config := s.GetConfig()
+	if len(config.WatchdogLabels) == 0 {
+		return "webhook", lastWebhookVar, current.LastWebhook
+	}
+	var matchers []string
+	for k, v := range config.WatchdogLabels {
+		matchers = append(matchers, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(matchers)
+	what = fmt.Sprintf("watchdog alert {%v}", strings.Join(matchers, ", "))
+	return what, lastWatchdogAlertVar, current.LastWatchdogAlert
+}
+
+// watchdogResult computes the webhook watchdog check result. The watchdog is
+// CRITICAL if what the watchdog watches hasn't been received within the
+// watchdog window, last being the last time it was received. Before it is
+// received for the first time, the window starts when Signalilo was
+// started.
+func (s *ServeCommand) watchdogResult(ts time.Time, what string, last time.Time) icinga2.Action {
+	config := s.GetConfig()
+
+	exitStatus := 0
+	var msg string
+	switch {
+	case last.IsZero() && ts.Sub(s.startTime) < config.WatchdogWindow:
+		msg = fmt.Sprintf("OK: no %v received yet, started at %v", what, s.startTime.Format(time.RFC3339))
+	case last.IsZero():
+		exitStatus = 2
+		msg = fmt.Sprintf("CRITICAL: no %v received since start at %v", what, s.startTime.Format(time.RFC3339))
+	case ts.Sub(last) >= config.WatchdogWindow:
+		exitStatus = 2
+		msg = fmt.Sprintf("CRITICAL: last %v received at %v, more than %v ago", what, last.Format(time.RFC3339), config.WatchdogWindow)
+	default:
+		msg = fmt.Sprintf("OK: last %v received at %v", what, last.Format(time.RFC3339))
+	}
+
+	return icinga2.Action{
+		ExitStatus:     exitStatus,
+		PluginOutput:   msg,
+		CheckSource:    config.CheckSource,
+		ExecutionStart: webhook.IcingaTimestamp(ts),
+		ExecutionEnd:   webhook.IcingaTimestamp(ts),
+	}
+}
+
+func (s *ServeCommand) startWatchdog(ctx context.Context) error {
+	window := s.GetConfig().WatchdogWindow
+	if window <= 0 {
+		return nil
+	}
+	// Check a couple of times per window, but at least as often as the
+	// heartbeat
+	interval := window / 4
+	if hbInterval := s.GetConfig().HeartbeatInterval; hbInterval < interval {
+		interval = hbInterval
+	}
+	s.watchdogTicker = time.NewTicker(interval)
+	s.logger.Infof("Starting webhook watchdog: window %v, interval %v", window, interval)
+
+	s.runTicker(ctx, s.watchdogTicker, func(ts time.Time) {
+		if err := s.watchdog(ts); err != nil {
+			s.logger.Errorf("sending watchdog state: %s", err)
+		}
+	})
+	return nil
+}
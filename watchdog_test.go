@@ -0,0 +1,128 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/leader"
+	"github.com/vshn/signalilo/stats"
+)
+
+func TestWatchdogResult(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := &ServeCommand{startTime: start}
+	s.config.WatchdogWindow = 10 * time.Minute
+	result := func(ts time.Time, current stats.Snapshot) icinga2.Action {
+		what, _, last := s.watchdogSubject(current)
+		return s.watchdogResult(ts, what, last)
+	}
+
+	assert := assert.New(t)
+
+	action := result(start.Add(5*time.Minute), stats.Snapshot{})
+	assert.Equal(0, action.ExitStatus, "within window after start")
+	action = result(start.Add(10*time.Minute), stats.Snapshot{})
+	assert.Equal(2, action.ExitStatus, "no webhook since start")
+	assert.Equal("CRITICAL: no webhook received since start at 2020-01-01T12:00:00Z", action.PluginOutput)
+
+	current := stats.Snapshot{LastWebhook: start.Add(20 * time.Minute)}
+	action = result(start.Add(25*time.Minute), current)
+	assert.Equal(0, action.ExitStatus, "recent webhook")
+	action = result(start.Add(30*time.Minute), current)
+	assert.Equal(2, action.ExitStatus, "webhook too old")
+
+	s.config.WatchdogLabels = map[string]string{"alertname": "Watchdog"}
+	action = result(start.Add(25*time.Minute), current)
+	assert.Equal(2, action.ExitStatus, "webhooks without watchdog alert")
+	assert.Equal("CRITICAL: no watchdog alert {alertname=Watchdog} received since start at 2020-01-01T12:00:00Z", action.PluginOutput)
+	current.LastWatchdogAlert = start.Add(20 * time.Minute)
+	action = result(start.Add(25*time.Minute), current)
+	assert.Equal(0, action.ExitStatus, "recent watchdog alert")
+}
+
+// newWatchdogReplica creates a replica which takes part in the leader
+// election for lease as identity
+func newWatchdogReplica(ctx context.Context, icinga icinga2.Client, lease leader.Lease, identity string) *ServeCommand {
+	s := &ServeCommand{startTime: time.Now(), stats: stats.New(), icingaClient: icinga}
+	s.logger = config.MockLogger(1)
+	s.config.HostName = "signalilo_test"
+	s.config.WatchdogWindow = 10 * time.Minute
+	s.config.WatchdogServiceName = "webhook_watchdog"
+	s.leaderAcquired = make(chan struct{}, 1)
+	s.elector = leader.NewElector(lease, identity, time.Minute, s.leadershipChanged, s.logger)
+	go s.elector.Run(ctx)
+	return s
+}
+
+func TestWatchdogSharesLastWebhook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	icinga := icinga2.NewMockClient()
+	lease := leader.NewFileLease(filepath.Join(t.TempDir(), "lease"))
+	leading := newWatchdogReplica(ctx, icinga, lease, "leader")
+	assert.Eventually(t, leading.isLeader, time.Second, time.Millisecond)
+	standby := newWatchdogReplica(ctx, icinga, lease, "standby")
+	assert.False(t, standby.isLeader())
+
+	ts := time.Now().Add(time.Hour)
+	assert.NoError(t, leading.watchdog(ts))
+	actions := icinga.Actions["signalilo_test!webhook_watchdog"]
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, 2, actions[0].ExitStatus, "no webhook received by any replica")
+	}
+
+	_, shared := icinga.Services["signalilo_test!webhook_watchdog"].Vars["signalilo_last_webhook_leader"]
+	assert.False(t, shared, "the leader doesn't share its time")
+
+	other := newWatchdogReplica(ctx, icinga, lease, "other.standby")
+	other.stats.WebhookStarted(ts.Add(-2 * time.Minute))
+	assert.NoError(t, other.watchdog(ts))
+	standby.stats.WebhookStarted(ts.Add(-time.Minute))
+	assert.NoError(t, standby.watchdog(ts))
+	assert.Len(t, icinga.Actions["signalilo_test!webhook_watchdog"], 1, "only the leader submits the watchdog state")
+	vars := icinga.Services["signalilo_test!webhook_watchdog"].Vars
+	assert.Equal(t, ts.Add(-time.Minute).UTC().Format(time.RFC3339Nano), vars["signalilo_last_webhook_standby"])
+	assert.Equal(t, ts.Add(-2*time.Minute).UTC().Format(time.RFC3339Nano), vars["signalilo_last_webhook_other_standby"],
+		"replicas don't overwrite each other's time")
+
+	assert.NoError(t, leading.watchdog(ts))
+	actions = icinga.Actions["signalilo_test!webhook_watchdog"]
+	if assert.Len(t, actions, 2) {
+		assert.Equal(t, 0, actions[1].ExitStatus, "webhook received by standby replica")
+		assert.Contains(t, actions[1].PluginOutput, ts.Add(-time.Minute).UTC().Format(time.RFC3339), "latest time of all replicas")
+	}
+}
+
+func TestReplicaVar(t *testing.T) {
+	assert.Equal(t, "signalilo_last_webhook_signalilo_7d9f_abc", replicaVar(lastWebhookVar, "signalilo-7d9f.abc"))
+}
+
+func TestWatchdogCreatesService(t *testing.T) {
+	s := &ServeCommand{startTime: time.Now(), stats: stats.New()}
+	s.logger = config.MockLogger(1)
+	s.config.HostName = "signalilo_test"
+	s.config.WatchdogWindow = 10 * time.Minute
+	s.config.WatchdogServiceName = "webhook_watchdog"
+	icinga := icinga2.NewMockClient()
+	s.icingaClient = icinga
+
+	assert.NoError(t, s.watchdog(time.Now()))
+	assert.Contains(t, icinga.Services, "signalilo_test!webhook_watchdog")
+	_, hasUUID := icinga.Services["signalilo_test!webhook_watchdog"].Vars["bridge_uuid"]
+	assert.False(t, hasUUID, "watchdog service isn't garbage collected")
+	assert.Len(t, icinga.Actions["signalilo_test!webhook_watchdog"], 1)
+}
@@ -0,0 +1,150 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/tracing"
+)
+
+// alertmanagerAPITimeout limits how long fetching alerts from the
+// Alertmanager API may take
+const alertmanagerAPITimeout = 10 * time.Second
+
+// gettableAlert is an alert as returned by the Alertmanager v2 API
+type gettableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// fetchGroupAlerts fetches the active alerts of the group of data from the
+// Alertmanager v2 API, using the group labels as matchers. Only alerts
+// routed to the receiver of data are returned.
+func fetchGroupAlerts(ctx context.Context, c config.Configuration, data template.Data) (template.Alerts, error) {
+	cfg := c.GetConfig().AlertManagerConfig
+	ctx, span := tracing.Start(ctx, "alertmanager.get_alerts")
+	defer span.End()
+
+	endpoint, err := alertsURL(cfg.APIURL, data)
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, alertmanagerAPITimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if cfg.APIBearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIBearerToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Alertmanager API returned %v", resp.Status)
+		tracing.Fail(span, err)
+		return nil, err
+	}
+
+	fetched := []gettableAlert{}
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		tracing.Fail(span, err)
+		return nil, fmt.Errorf("decoding Alertmanager API response: %w", err)
+	}
+	alerts := make(template.Alerts, 0, len(fetched))
+	for _, a := range fetched {
+		alerts = append(alerts, template.Alert{
+			// The API only returns unresolved alerts
+			Status:       string(model.AlertFiring),
+			Labels:       a.Labels,
+			Annotations:  a.Annotations,
+			StartsAt:     a.StartsAt,
+			EndsAt:       a.EndsAt,
+			GeneratorURL: a.GeneratorURL,
+			Fingerprint:  a.Fingerprint,
+		})
+	}
+	span.SetAttributes(tracing.AttrAlerts.Int(len(alerts)))
+	return alerts, nil
+}
+
+// alertsURL returns the URL of the Alertmanager v2 API request for the
+// active, unsilenced and uninhibited alerts of the group of data
+func alertsURL(apiURL string, data template.Data) (string, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid Alertmanager API URL: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/alerts"
+	query := url.Values{}
+	query.Set("active", "true")
+	query.Set("silenced", "false")
+	query.Set("inhibited", "false")
+	if data.Receiver != "" {
+		query.Set("receiver", "^"+regexp.QuoteMeta(data.Receiver)+"$")
+	}
+	names := make([]string, 0, len(data.GroupLabels))
+	for name := range data.GroupLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query.Add("filter", name+"="+strconv.Quote(data.GroupLabels[name]))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// mergeAlerts adds the alerts of fetched which aren't in alerts, up to max
+// alerts in total, and returns the number of alerts added. 0 allows any
+// number of alerts.
+func mergeAlerts(alerts, fetched template.Alerts, max int) (template.Alerts, int) {
+	known := map[string]bool{}
+	for _, alert := range alerts {
+		known[alert.Fingerprint] = true
+	}
+	added := 0
+	for _, alert := range fetched {
+		if max > 0 && len(alerts) >= max {
+			break
+		}
+		if known[alert.Fingerprint] {
+			continue
+		}
+		known[alert.Fingerprint] = true
+		alerts = append(alerts, alert)
+		added++
+	}
+	return alerts, added
+}
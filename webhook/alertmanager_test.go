@@ -0,0 +1,105 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+func TestAlertsURL(t *testing.T) {
+	data := template.Data{Receiver: "signalilo", GroupLabels: template.KV{"namespace": `a"b`, "alertname": "Test"}}
+	raw, err := alertsURL("https://alertmanager:9093/prefix/", data)
+	assert.NoError(t, err)
+	u, err := url.Parse(raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/prefix/api/v2/alerts", u.Path)
+	assert.Equal(t, []string{`alertname="Test"`, `namespace="a\"b"`}, u.Query()["filter"])
+	assert.Equal(t, "^signalilo$", u.Query().Get("receiver"))
+	assert.Equal(t, "false", u.Query().Get("silenced"))
+}
+
+func TestMergeAlerts(t *testing.T) {
+	alerts, added := mergeAlerts(
+		template.Alerts{{Fingerprint: "a"}},
+		template.Alerts{{Fingerprint: "a"}, {Fingerprint: "b"}, {Fingerprint: "b"}},
+		0,
+	)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, template.Alerts{{Fingerprint: "a"}, {Fingerprint: "b"}}, alerts)
+
+	alerts, added = mergeAlerts(
+		template.Alerts{{Fingerprint: "a"}},
+		template.Alerts{{Fingerprint: "b"}, {Fingerprint: "c"}},
+		2,
+	)
+	assert.Equal(t, 1, added, "fetched alerts don't exceed the maximum number of alerts")
+	assert.Len(t, alerts, 2)
+}
+
+const truncatedPayload = `{
+  "version": "4",
+  "status": "firing",
+  "receiver": "signalilo",
+  "groupLabels": {"alertname": "Truncated"},
+  "truncatedAlerts": 1,
+  "alerts": [
+    {"status": "firing", "fingerprint": "f1", "startsAt": "2019-01-01T00:00:00Z", "labels": {"alertname": "Truncated", "severity": "critical", "instance": "a"}}
+  ]
+}`
+
+func TestWebhookTruncatedAlerts(t *testing.T) {
+	var query url.Values
+	var authorization string
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `[
+  {"fingerprint": "f1", "startsAt": "2019-01-01T00:00:00Z", "labels": {"alertname": "Truncated", "severity": "critical", "instance": "a"}},
+  {"fingerprint": "f2", "startsAt": "2019-01-01T00:00:00Z", "labels": {"alertname": "Truncated", "severity": "critical", "instance": "b"}, "annotations": {"message": "fetched"}}
+]`)
+	}))
+	defer am.Close()
+
+	conf := config.NewMockConfiguration(1)
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+
+	assert.Equal(t, http.StatusOK, postWebhook(conf, truncatedPayload).Code)
+	assert.Len(t, icinga.Services, 1, "truncated alerts are lost without Alertmanager API")
+	assert.Equal(t, uint64(1), conf.GetStats().Snapshot().AlertsTruncated)
+	assert.Equal(t, uint64(0), conf.GetStats().Snapshot().AlertsRecovered)
+
+	conf.GetConfig().AlertManagerConfig.APIURL = am.URL
+	conf.GetConfig().AlertManagerConfig.APIBearerToken = "amtoken"
+	assert.Equal(t, http.StatusOK, postWebhook(conf, truncatedPayload).Code)
+	assert.Equal(t, []string{`alertname="Truncated"`}, query["filter"])
+	assert.Equal(t, "Bearer amtoken", authorization)
+	assert.Len(t, icinga.Services, 2, "truncated alerts are fetched from the Alertmanager API")
+	assert.Equal(t, uint64(2), conf.GetStats().Snapshot().AlertsTruncated)
+	assert.Equal(t, uint64(1), conf.GetStats().Snapshot().AlertsRecovered)
+	assert.Equal(t, uint64(3), conf.GetStats().Snapshot().AlertsProcessed)
+
+	am.Close()
+	assert.Equal(t, http.StatusOK, postWebhook(conf, truncatedPayload).Code, "alerts of the payload are delivered if fetching fails")
+	assert.Equal(t, uint64(3), conf.GetStats().Snapshot().AlertsTruncated)
+	assert.Equal(t, uint64(1), conf.GetStats().Snapshot().AlertsRecovered)
+}
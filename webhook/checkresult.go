@@ -0,0 +1,122 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+// IcingaTimestamp formats ts as the Unix timestamp expected by the Icinga
+// API for check result execution times
+func IcingaTimestamp(ts time.Time) icinga2.TimeStamp {
+	return icinga2.TimeStamp(strconv.FormatFloat(float64(ts.UnixNano())/1e9, 'f', 3, 64))
+}
+
+// computePluginOutput returns the value of the first annotation configured
+// as plugin output annotation that has some data
+func computePluginOutput(alert template.Alert, exitStatus int, c config.Configuration) string {
+	amConfig := c.GetConfig().AlertManagerConfig
+
+	pluginOutput := ""
+	for _, v := range amConfig.PluginOutputAnnotations {
+
+		// If the PluginOutputByStates option is enabled then first look for an annotation with the state suffix
+		// otherwise fall back to just using the PluginOutputAnnotations value as is
+		if amConfig.PluginOutputByStates {
+			pluginOutput = alert.Annotations[fmt.Sprintf("%s_%s", v, amConfig.PluginOutputStateSuffixes[exitStatus])]
+			if pluginOutput != "" {
+				break
+			}
+		}
+
+		pluginOutput = alert.Annotations[v]
+		if pluginOutput != "" {
+			break
+		}
+	}
+	return pluginOutput
+}
+
+// computeLongOutput renders the configured long output annotations and,
+// if enabled, all of the alert's labels into the check result's long
+// output
+func computeLongOutput(alert template.Alert, c config.Configuration) string {
+	amConfig := c.GetConfig().AlertManagerConfig
+
+	var sections []string
+	for _, v := range amConfig.LongOutputAnnotations {
+		if annotation := alert.Annotations[v]; annotation != "" {
+			sections = append(sections, annotation)
+		}
+	}
+
+	if amConfig.LongOutputLabels && len(alert.Labels) > 0 {
+		var keys []string
+		for k := range alert.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var sb strings.Builder
+		sb.WriteString("Labels:")
+		for _, k := range keys {
+			sb.WriteString(fmt.Sprintf("\n%v=%v", k, alert.Labels[k]))
+		}
+		sections = append(sections, sb.String())
+	}
+
+	return strings.Join(sections, "\n\n")
+}
+
+// alertExecutionTimes computes the check result's execution start and end
+// from the time the alert started firing and, for resolved alerts, the
+// time it was resolved. Firing alerts end at now, as Alertmanager sets
+// EndsAt to the time at which it would consider the alert resolved.
+func alertExecutionTimes(alert template.Alert, now time.Time) (time.Time, time.Time) {
+	end := now
+	if alert.Status == "resolved" && !alert.EndsAt.IsZero() && alert.EndsAt.Before(now) {
+		end = alert.EndsAt
+	}
+	start := alert.StartsAt
+	if start.IsZero() || start.After(end) {
+		start = end
+	}
+	return start, end
+}
+
+// createCheckResult creates the check result which is submitted to Icinga
+// for the alert
+func createCheckResult(alert template.Alert, exitStatus int, now time.Time, c config.Configuration) icinga2.Action {
+	output := computePluginOutput(alert, exitStatus, c)
+	// Icinga treats everything after the first line of the plugin output
+	// as long output
+	if longOutput := computeLongOutput(alert, c); longOutput != "" {
+		output = fmt.Sprintf("%v\n%v", output, longOutput)
+	}
+
+	start, end := alertExecutionTimes(alert, now)
+
+	return icinga2.Action{
+		ExitStatus:      exitStatus,
+		PluginOutput:    output,
+		PerformanceData: computePerfData(alert, c),
+		CheckSource:     c.GetConfig().CheckSource,
+		ExecutionStart:  IcingaTimestamp(start),
+		ExecutionEnd:    IcingaTimestamp(end),
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+func TestIcingaTimestamp(t *testing.T) {
+	ts := time.Unix(1600000000, 250000000)
+	assert.Equal(t, icinga2.TimeStamp("1600000000.250"), IcingaTimestamp(ts))
+}
+
+func TestAlertExecutionTimes(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	startsAt := now.Add(-time.Hour)
+
+	firing := template.Alert{Status: "firing", StartsAt: startsAt, EndsAt: now.Add(5 * time.Minute)}
+	start, end := alertExecutionTimes(firing, now)
+	assert.Equal(t, startsAt, start, "firing alert starts at StartsAt")
+	assert.Equal(t, now, end, "firing alert ends now")
+
+	resolved := template.Alert{Status: "resolved", StartsAt: startsAt, EndsAt: now.Add(-time.Minute)}
+	start, end = alertExecutionTimes(resolved, now)
+	assert.Equal(t, startsAt, start, "resolved alert starts at StartsAt")
+	assert.Equal(t, now.Add(-time.Minute), end, "resolved alert ends at EndsAt")
+
+	start, end = alertExecutionTimes(template.Alert{Status: "firing"}, now)
+	assert.Equal(t, now, start, "missing StartsAt")
+	assert.Equal(t, now, end, "missing StartsAt")
+}
+
+func TestCreateCheckResult(t *testing.T) {
+	c := config.NewMockConfiguration(1)
+	c.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"message"}
+	c.GetConfig().AlertManagerConfig.LongOutputAnnotations = []string{"description"}
+	c.GetConfig().AlertManagerConfig.LongOutputLabels = true
+	c.GetConfig().CheckSource = "signalilo-0"
+
+	now := time.Unix(1600000000, 0)
+	alert := template.Alert{
+		Status: "firing",
+		Labels: map[string]string{
+			"alertname": "DiskFull",
+			"severity":  "critical",
+		},
+		Annotations: map[string]string{
+			"message":     "Disk is full",
+			"description": "The disk on node-1 has less than 10% free space.",
+		},
+		StartsAt: now.Add(-time.Hour),
+	}
+
+	action := createCheckResult(alert, 2, now, c)
+	assert.Equal(t, 2, action.ExitStatus)
+	assert.Equal(t, "Disk is full\nThe disk on node-1 has less than 10% free space.\n\nLabels:\nalertname=DiskFull\nseverity=critical", action.PluginOutput)
+	assert.Equal(t, "signalilo-0", action.CheckSource)
+	assert.Equal(t, icinga2.TimeStamp("1599996400.000"), action.ExecutionStart)
+	assert.Equal(t, icinga2.TimeStamp("1600000000.000"), action.ExecutionEnd)
+
+	c.GetConfig().AlertManagerConfig.LongOutputAnnotations = nil
+	c.GetConfig().AlertManagerConfig.LongOutputLabels = false
+	action = createCheckResult(alert, 2, now, c)
+	assert.Equal(t, "Disk is full", action.PluginOutput, "no long output")
+}
@@ -0,0 +1,123 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+// maxCachedResults bounds the number of services for which the last check
+// result is remembered. Once it's reached, the least recently submitted
+// check result is forgotten, which at worst causes an unchanged check result
+// to be submitted again.
+const maxCachedResults = 10000
+
+// submittedResult holds the relevant parts of the last check result which
+// was submitted to Icinga for a service
+type submittedResult struct {
+	svcName      string
+	exitStatus   int
+	pluginOutput string
+	submittedAt  time.Time
+}
+
+// checkResultCache remembers the last check result submitted for each
+// service, so that alerts which Alertmanager re-sends every
+// `repeat_interval` don't end up as a new check result in Icinga every time.
+type checkResultCache struct {
+	mutex   sync.Mutex
+	max     int
+	results map[string]*list.Element
+	// order holds the submittedResults, most recently submitted first
+	order *list.List
+}
+
+func newCheckResultCache(max int) *checkResultCache {
+	return &checkResultCache{
+		max:     max,
+		results: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// resultCache is shared by all webhook requests handled by this Signalilo
+// instance
+var resultCache = newCheckResultCache(maxCachedResults)
+
+// isDuplicate returns true if the last check result submitted for service
+// svcName has the same exit status and plugin output as action, and was
+// submitted less than refreshInterval before now. A refreshInterval of zero
+// means that unchanged check results are never resubmitted.
+func (cache *checkResultCache) isDuplicate(svcName string, action icinga2.Action, refreshInterval time.Duration, now time.Time) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, ok := cache.results[svcName]
+	if !ok {
+		return false
+	}
+	last := elem.Value.(submittedResult)
+	if last.exitStatus != action.ExitStatus || last.pluginOutput != action.PluginOutput {
+		return false
+	}
+	if refreshInterval > 0 && now.Sub(last.submittedAt) >= refreshInterval {
+		return false
+	}
+	return true
+}
+
+// record stores action as the last check result submitted for service
+// svcName
+func (cache *checkResultCache) record(svcName string, action icinga2.Action, now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	result := submittedResult{
+		svcName:      svcName,
+		exitStatus:   action.ExitStatus,
+		pluginOutput: action.PluginOutput,
+		submittedAt:  now,
+	}
+	if elem, ok := cache.results[svcName]; ok {
+		elem.Value = result
+		cache.order.MoveToFront(elem)
+		return
+	}
+	cache.results[svcName] = cache.order.PushFront(result)
+	for cache.order.Len() > cache.max {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.results, oldest.Value.(submittedResult).svcName)
+	}
+}
+
+// forget removes the cached check result for service svcName. This must be
+// called whenever the service is (re)created in Icinga, as a fresh service
+// object doesn't have any check results yet.
+func (cache *checkResultCache) forget(svcName string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if elem, ok := cache.results[svcName]; ok {
+		cache.order.Remove(elem)
+		delete(cache.results, svcName)
+	}
+}
+
+// ForgetCheckResult forgets the last check result submitted for the service
+// with the full name svcName, e.g. because the service's state was changed
+// outside of the webhook
+func ForgetCheckResult(svcName string) {
+	resultCache.forget(svcName)
+}
@@ -0,0 +1,54 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+)
+
+func TestCheckResultCache(t *testing.T) {
+	cache := newCheckResultCache(maxCachedResults)
+	now := time.Now()
+	action := icinga2.Action{ExitStatus: 2, PluginOutput: "disk full"}
+
+	assert.False(t, cache.isDuplicate("host!svc", action, 0, now), "unknown service is never a duplicate")
+
+	cache.record("host!svc", action, now)
+	assert.True(t, cache.isDuplicate("host!svc", action, 0, now.Add(24*time.Hour)), "unchanged result without refresh interval")
+	assert.True(t, cache.isDuplicate("host!svc", action, time.Hour, now.Add(30*time.Minute)), "unchanged result within refresh interval")
+	assert.False(t, cache.isDuplicate("host!svc", action, time.Hour, now.Add(time.Hour)), "unchanged result after refresh interval")
+
+	changedState := icinga2.Action{ExitStatus: 0, PluginOutput: "disk full"}
+	assert.False(t, cache.isDuplicate("host!svc", changedState, 0, now), "changed exit status")
+	changedOutput := icinga2.Action{ExitStatus: 2, PluginOutput: "disk still full"}
+	assert.False(t, cache.isDuplicate("host!svc", changedOutput, 0, now), "changed plugin output")
+
+	cache.forget("host!svc")
+	assert.False(t, cache.isDuplicate("host!svc", action, 0, now), "forgotten service")
+}
+
+func TestCheckResultCacheBounded(t *testing.T) {
+	cache := newCheckResultCache(2)
+	now := time.Now()
+	action := icinga2.Action{ExitStatus: 2, PluginOutput: "disk full"}
+
+	cache.record("host!a", action, now)
+	cache.record("host!b", action, now)
+	cache.record("host!a", action, now.Add(time.Minute))
+	cache.record("host!c", action, now.Add(2*time.Minute))
+	assert.Len(t, cache.results, 2)
+	assert.False(t, cache.isDuplicate("host!b", action, 0, now), "least recently submitted result is forgotten")
+	assert.True(t, cache.isDuplicate("host!a", action, 0, now))
+	assert.True(t, cache.isDuplicate("host!c", action, 0, now))
+}
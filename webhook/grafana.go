@@ -0,0 +1,106 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+// grafanaAlert is a single alert of a Grafana unified alerting webhook
+type grafanaAlert struct {
+	template.Alert
+	DashboardURL string             `json:"dashboardURL"`
+	PanelURL     string             `json:"panelURL"`
+	SilenceURL   string             `json:"silenceURL"`
+	Values       map[string]float64 `json:"values"`
+	ValueString  string             `json:"valueString"`
+}
+
+// grafanaData is the payload of a Grafana unified alerting webhook. Apart
+// from the alerts, it has the same fields as an Alertmanager webhook.
+type grafanaData struct {
+	template.Data
+	Alerts []grafanaAlert `json:"alerts"`
+}
+
+// GrafanaWebhook handles incoming webhook HTTP requests from Grafana
+// unified alerting
+func GrafanaWebhook(w http.ResponseWriter, r *http.Request, c config.Configuration) {
+	r = r.WithContext(withServiceMapping(r.Context(), mapGrafanaService))
+	handleWebhook(w, r, c, decodeGrafana)
+}
+
+// mapGrafanaService links the dashboard as notes URL of the service, unless
+// the alert has a runbook
+func mapGrafanaService(alert template.Alert, svc *icinga2.Service) {
+	if svc.NotesURL == "" {
+		svc.NotesURL = alert.Annotations["dashboard_url"]
+	}
+}
+
+// decodeGrafana decodes a Grafana webhook payload into Alertmanager alerts
+func decodeGrafana(ctx context.Context, body io.Reader, c config.Configuration) (template.Data, error) {
+	payload := grafanaData{}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return template.Data{}, err
+	}
+	data := payload.Data
+	data.Alerts = make(template.Alerts, 0, len(payload.Alerts))
+	for _, alert := range payload.Alerts {
+		data.Alerts = append(data.Alerts, alert.toAlert(c))
+	}
+	return data, nil
+}
+
+// toAlert converts the Grafana alert into an Alertmanager alert. The panel
+// or dashboard is linked as action URL. The values of the alert's queries are
+// rendered as performance data and used as plugin output if none of the
+// plugin output annotations is set.
+func (a grafanaAlert) toAlert(c config.Configuration) template.Alert {
+	alert := a.Alert
+	annotations := template.KV{}
+	for k, v := range a.Annotations {
+		annotations[k] = v
+	}
+	alert.Annotations = annotations
+	setDefault := func(name, value string) {
+		if value != "" && annotations[name] == "" {
+			annotations[name] = value
+		}
+	}
+
+	setDefault("dashboard_url", a.DashboardURL)
+	setDefault("panel_url", a.PanelURL)
+	setDefault("silence_url", a.SilenceURL)
+	if a.PanelURL != "" {
+		alert.GeneratorURL = a.PanelURL
+	} else if a.DashboardURL != "" {
+		alert.GeneratorURL = a.DashboardURL
+	}
+
+	for ref, value := range a.Values {
+		setDefault(perfDataKeyPrefix+ref, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	exitStatus := severityToExitStatus(alert.Status, alert.Labels["severity"], c.GetConfig().MergedSeverityLevels)
+	pluginOutputAnnotations := c.GetConfig().AlertManagerConfig.PluginOutputAnnotations
+	if computePluginOutput(alert, exitStatus, c) == "" && len(pluginOutputAnnotations) > 0 {
+		setDefault(pluginOutputAnnotations[0], a.ValueString)
+	}
+	return alert
+}
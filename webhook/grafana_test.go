@@ -0,0 +1,115 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+const grafanaPayload = `{
+  "receiver": "signalilo",
+  "status": "firing",
+  "orgId": 1,
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "HighCPU", "severity": "critical", "grafana_folder": "Infra"},
+      "annotations": {"description": "CPU usage is high"},
+      "startsAt": "2022-06-01T10:00:00Z",
+      "endsAt": "0001-01-01T00:00:00Z",
+      "generatorURL": "https://grafana/alerting/grafana/abc/view",
+      "fingerprint": "c6eadffa33fcdf37",
+      "silenceURL": "https://grafana/alerting/silence/new",
+      "dashboardURL": "https://grafana/d/dash",
+      "panelURL": "https://grafana/d/dash?viewPanel=2",
+      "values": {"B": 95.5, "C": 1},
+      "valueString": "[ var='B' labels={instance=node1} value=95.5 ]"
+    }
+  ],
+  "groupLabels": {"alertname": "HighCPU"},
+  "commonLabels": {"alertname": "HighCPU"},
+  "commonAnnotations": {},
+  "externalURL": "https://grafana/",
+  "version": "1",
+  "groupKey": "{}:{alertname=\"HighCPU\"}",
+  "truncatedAlerts": 0,
+  "title": "[FIRING:1] HighCPU",
+  "state": "alerting",
+  "message": "**Firing**"
+}`
+
+func TestDecodeGrafana(t *testing.T) {
+	c := config.NewMockConfiguration(1)
+	c.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"message"}
+
+	data, err := decodeGrafana(context.Background(), strings.NewReader(grafanaPayload), c)
+	assert.NoError(t, err)
+	assert.Equal(t, "signalilo", data.Receiver)
+	assert.Equal(t, "HighCPU", data.GroupLabels["alertname"])
+	if !assert.Len(t, data.Alerts, 1) {
+		return
+	}
+	alert := data.Alerts[0]
+	assert.Equal(t, "c6eadffa33fcdf37", alert.Fingerprint)
+	assert.Equal(t, "https://grafana/d/dash?viewPanel=2", alert.GeneratorURL, "the panel is linked as action URL")
+	assert.Equal(t, "https://grafana/d/dash", alert.Annotations["dashboard_url"])
+	assert.NotContains(t, alert.Annotations, "runbook_url")
+	assert.Equal(t, "https://grafana/alerting/silence/new", alert.Annotations["silence_url"])
+	assert.Equal(t, "95.5", alert.Annotations["icinga_perfdata_B"])
+	assert.Equal(t, "1", alert.Annotations["icinga_perfdata_C"])
+	assert.Equal(t, "[ var='B' labels={instance=node1} value=95.5 ]", alert.Annotations["message"], "value string is the fallback plugin output")
+
+	c.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"description"}
+	data, err = decodeGrafana(context.Background(), strings.NewReader(grafanaPayload), c)
+	assert.NoError(t, err)
+	assert.Equal(t, "CPU usage is high", data.Alerts[0].Annotations["description"])
+	assert.NotContains(t, data.Alerts[0].Annotations, "message", "plugin output annotations take precedence")
+
+	_, err = decodeGrafana(context.Background(), strings.NewReader("{"), c)
+	assert.Error(t, err)
+}
+
+func TestGrafanaWebhook(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	conf.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"message"}
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook/grafana", strings.NewReader(grafanaPayload))
+	req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+	rec := httptest.NewRecorder()
+	GrafanaWebhook(rec, req, conf)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	if !assert.Len(t, icinga.Services, 1) {
+		return
+	}
+	for name, svc := range icinga.Services {
+		assert.Equal(t, "https://grafana/d/dash", svc.NotesURL)
+		assert.NotContains(t, svc.Vars, "annotation_runbook_url", "the dashboard isn't passed off as runbook")
+		assert.Equal(t, "https://grafana/d/dash?viewPanel=2", svc.ActionURL)
+		assert.Equal(t, "CPU usage is high", svc.Notes)
+		actions := icinga.Actions[name]
+		if assert.Len(t, actions, 1) {
+			assert.Equal(t, 2, actions[0].ExitStatus)
+			assert.Equal(t, "[ var='B' labels={instance=node1} value=95.5 ]", actions[0].PluginOutput)
+			assert.Equal(t, icinga2.PerfData{"B=95.5", "C=1"}, actions[0].PerformanceData)
+		}
+	}
+}
@@ -10,14 +10,27 @@
 package webhook
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/bketelsen/logr"
 	"github.com/prometheus/alertmanager/template"
 	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
 	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/logging"
+	"github.com/vshn/signalilo/stats"
+	"github.com/vshn/signalilo/tracing"
 )
 
 // responseJSON is used to marshal responses to incoming webhook requests to
@@ -25,22 +38,45 @@ import (
 type responseJSON struct {
 	Status  int
 	Message string
+	Errors  []fieldError `json:",omitempty"`
 }
 
 // asJSON formats a response to a webhook request using type responseJSON
 func asJSON(w http.ResponseWriter, status int, message string) {
-	data := responseJSON{
+	writeResponse(w, responseJSON{
 		Status:  status,
 		Message: message,
-	}
+	})
+}
+
+// writeResponse writes data as response to a webhook request
+func writeResponse(w http.ResponseWriter, data responseJSON) {
 	bytes, _ := json.Marshal(data)
 	json := string(bytes[:])
 
-	w.WriteHeader(status)
+	w.WriteHeader(data.Status)
 	fmt.Fprint(w, json)
 }
 
-func checkBearerToken(r *http.Request, c config.Configuration) error {
+// badRequest responds to a webhook request which can't be processed because
+// of err, listing the invalid fields of validation errors
+func badRequest(w http.ResponseWriter, err error) {
+	var verr validationError
+	if errors.As(err, &verr) {
+		writeResponse(w, responseJSON{
+			Status:  http.StatusBadRequest,
+			Message: "invalid payload",
+			Errors:  verr,
+		})
+		return
+	}
+	asJSON(w, http.StatusBadRequest, err.Error())
+}
+
+// CheckBearerToken checks that the request carries the bearer token
+// expected, either in the Authorization header or in the token query
+// parameter
+func CheckBearerToken(r *http.Request, expected string) error {
 	tokenHeader := r.Header.Get("Authorization")
 	tokenQuery := r.URL.Query().Get("token")
 	var token string
@@ -55,46 +91,202 @@ func checkBearerToken(r *http.Request, c config.Configuration) error {
 	} else {
 		return fmt.Errorf("Request dos not contain an authorization token")
 	}
-	if token != c.GetConfig().AlertManagerConfig.BearerToken {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
 		return fmt.Errorf("Invalid bearer token")
 	}
 	return nil
 }
 
-// Webhook handles incoming webhook HTTP requests
+func checkBearerToken(r *http.Request, c config.Configuration) error {
+	return CheckBearerToken(r, c.GetConfig().AlertManagerConfig.BearerToken)
+}
+
+// connectivityReporter is implemented by Icinga clients which know whether
+// they can currently reach the Icinga API
+type connectivityReporter interface {
+	Connected() bool
+}
+
+// isConnected returns false if there is no Icinga client, or if the client
+// knows that it can't reach the Icinga API
+func isConnected(icinga icinga2.Client) bool {
+	if icinga == nil {
+		return false
+	}
+	if reporter, ok := icinga.(connectivityReporter); ok {
+		return reporter.Connected()
+	}
+	return true
+}
+
+// decoder decodes the body of a webhook request into the alerts which are
+// delivered to Icinga
+type decoder func(ctx context.Context, body io.Reader, c config.Configuration) (template.Data, error)
+
+// alertmanagerPayload is the payload of an Alertmanager webhook
+type alertmanagerPayload struct {
+	// Godoc: https://godoc.org/github.com/prometheus/alertmanager/template#Data
+	template.Data
+	Version string `json:"version"`
+	// TruncatedAlerts is the number of alerts which Alertmanager dropped
+	// from the payload because of the max_alerts limit of the receiver
+	TruncatedAlerts int `json:"truncatedAlerts"`
+}
+
+// decodeAlertmanager decodes and validates an Alertmanager webhook payload.
+// If Alertmanager truncated the alerts of the group, and the Alertmanager
+// API is configured, the missing alerts are fetched from the API.
+func decodeAlertmanager(ctx context.Context, body io.Reader, c config.Configuration) (template.Data, error) {
+	payload := alertmanagerPayload{}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return template.Data{}, err
+	}
+	data := payload.Data
+	if err := validateAlertmanager(payload.Version, data, time.Now()); err != nil {
+		return data, err
+	}
+	if payload.TruncatedAlerts <= 0 {
+		return data, nil
+	}
+
+	l := c.GetLogger().WithField(logging.FieldRequestID, audit.RequestID(ctx))
+	l.Errorf("Alertmanager truncated %v alerts of group %v", payload.TruncatedAlerts, data.GroupLabels)
+	recovered := 0
+	if c.GetConfig().AlertManagerConfig.APIURL != "" {
+		fetched, err := fetchGroupAlerts(ctx, c, data)
+		if err != nil {
+			// Deliver the alerts of the payload anyway, as retrying the
+			// request wouldn't recover the truncated alerts
+			l.Errorf("Unable to fetch truncated alerts from Alertmanager API: %v", err)
+		} else {
+			data.Alerts, recovered = mergeAlerts(data.Alerts, fetched, c.GetConfig().AlertManagerConfig.MaxAlerts)
+			l.Infof("Fetched %v truncated alerts from Alertmanager API", recovered)
+		}
+	}
+	c.GetStats().AlertsTruncated(payload.TruncatedAlerts, recovered)
+	return data, nil
+}
+
+// errBodyTooLarge is returned by readBody if the request body exceeds the
+// maximum size
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads the request body, which may be at most max bytes. 0 allows
+// bodies of any size.
+func readBody(body io.Reader, max int64) (io.Reader, error) {
+	if max <= 0 {
+		return body, nil
+	}
+	content, err := io.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > max {
+		return nil, fmt.Errorf("%w, the maximum is %d bytes", errBodyTooLarge, max)
+	}
+	return bytes.NewReader(content), nil
+}
+
+// Webhook handles incoming webhook HTTP requests from Alertmanager
 func Webhook(w http.ResponseWriter, r *http.Request, c config.Configuration) {
+	handleWebhook(w, r, c, decodeAlertmanager)
+}
+
+// handleWebhook delivers the alerts of a webhook request, which are decoded
+// with decode, to Icinga
+func handleWebhook(w http.ResponseWriter, r *http.Request, c config.Configuration, decode decoder) {
 	defer r.Body.Close()
 
-	l := c.GetLogger()
-	if l == nil {
+	if c.GetLogger() == nil {
 		panic("logger is nil")
 	}
+	start := time.Now()
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+	l := c.GetLogger().WithField(logging.FieldRequestID, id)
+	ctx, span := tracing.Start(tracing.Extract(r), "webhook", tracing.AttrRequestID.String(id))
+	ctx = audit.WithRequestID(ctx, id)
+	defer span.End()
+
+	// Record the outcome of the request for the status page
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	var alerts, failed int
+	var failure error
+	defer func() {
+		c.GetStats().WebhookHandled(stats.WebhookRequest{
+			Timestamp: start,
+			RequestID: id,
+			Status:    rec.status,
+			Alerts:    alerts,
+			Failed:    failed,
+			Duration:  time.Since(start),
+			Error:     audit.ErrorMessage(failure),
+		})
+	}()
 
 	if err := checkBearerToken(r, c); err != nil {
 		l.Errorf("Checking webhook authentication: %v", err)
+		failure = err
 		asJSON(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
 	icinga := c.GetIcingaClient()
-	if icinga == nil {
-		panic("icinga client is nil")
+	if !isConnected(icinga) {
+		l.Errorf("Rejecting webhook: no Icinga API reachable")
+		// Alertmanager retries notifications which fail with a 5xx
+		// status
+		w.Header().Set("Retry-After", "30")
+		failure = fmt.Errorf("no Icinga API reachable")
+		asJSON(w, http.StatusServiceUnavailable, "no Icinga API reachable")
+		return
 	}
 
-	// Godoc: https://godoc.org/github.com/prometheus/alertmanager/template#Data
-	data := template.Data{}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		l.Errorf("Unable to decode request")
-		asJSON(w, http.StatusBadRequest, err.Error())
+	st := c.GetStats()
+	st.WebhookStarted(time.Now())
+	defer st.WebhookFinished()
+
+	body, err := readBody(r.Body, c.GetConfig().AlertManagerConfig.MaxBodySize)
+	if err != nil {
+		l.Errorf("Unable to read request: %v", err)
+		failure = err
+		status := http.StatusBadRequest
+		if errors.Is(err, errBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		asJSON(w, status, err.Error())
 		return
 	}
-	l.Infof("Alerts: GroupLabels=%v, CommonLabels=%v", data.GroupLabels, data.CommonLabels)
+	data, err := decode(ctx, body, c)
+	if err == nil {
+		err = validateAlertCount(data, c.GetConfig().AlertManagerConfig.MaxAlerts)
+	}
+	if err != nil {
+		l.Errorf("Unable to decode request: %v", err)
+		failure = err
+		badRequest(w, err)
+		return
+	}
+	span.SetAttributes(tracing.AttrAlerts.Int(len(data.Alerts)))
+	alerts = len(data.Alerts)
+	l.WithField("alerts", len(data.Alerts)).Infof("Alerts: GroupLabels=%v, CommonLabels=%v", data.GroupLabels, data.CommonLabels)
 
 	serviceHost := c.GetConfig().HostName
 	l.V(2).Infof("Check service host: %v", serviceHost)
-	host, err := icinga.GetHost(serviceHost)
+	var host icinga2.Host
+	hl, err := icingaCall(ctx, l, icinga, "get_host", func() (err error) {
+		host, err = icinga.GetHost(serviceHost)
+		return err
+	})
 	if err != nil {
-		l.Errorf("Did not find service host %v: %v\n", host, err)
+		hl.Errorf("Did not find service host %v: %v", host, err)
+		tracing.Fail(span, err)
+		failure = err
+		failed = len(data.Alerts)
+		for range data.Alerts {
+			st.AlertProcessed(true)
+		}
 		asJSON(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -108,74 +300,169 @@ func Webhook(w http.ResponseWriter, r *http.Request, c config.Configuration) {
 	}
 
 	for _, alert := range data.Alerts {
-		l.V(2).Infof("Processing %v alert: alertname=%v, severity=%v, message=%v",
-			alert.Status,
-			alert.Labels["alertname"],
-			alert.Labels["severity"],
-			alert.Annotations["message"])
-
-		// Compute service and display name for alert
-		serviceName, err := computeServiceName(data, alert, c)
-		if err != nil {
-			l.Errorf("Unable to compute internal service name: %v", err)
-		}
-		var displayName string
-		if c.GetConfig().DisplayNameAsServiceName {
-			displayName = serviceName
-		} else {
-			displayName, err = computeDisplayName(data, alert)
-			if err != nil {
-				l.Errorf("Unable to compute service display name: %v", err)
+		if IsWatchdogAlert(alert, c.GetConfig().WatchdogLabels) {
+			l.WithField(logging.FieldFingerprint, alert.Fingerprint).V(2).Infof("Received watchdog alert: %v", alert.Labels)
+			if alert.Status == "firing" {
+				st.WatchdogAlertReceived(time.Now())
 			}
+			continue
 		}
-
-		// Update or create service in icinga
-		svc, err := updateOrCreateService(icinga, serviceHost, serviceName, displayName, alert, c)
+		err := processAlert(ctx, l, icinga, serviceHost, data, alert, c)
 		if err != nil {
-			l.Errorf("Error in checkOrCreateService for %v: %v", serviceName, err)
-		}
-		// If we got an emtpy service object, the service was not
-		// created, don't try to call process-check-result
-		if svc.Name == "" {
-			continue
+			failed++
 		}
+		st.AlertProcessed(err != nil)
+	}
+
+	l.WithField(logging.FieldOperation, "webhook").
+		WithField(logging.FieldDuration, time.Since(start).Seconds()).
+		Infof("Processed %v alerts, %v not delivered", len(data.Alerts), failed)
+	asJSON(w, http.StatusOK, "success")
+}
 
-		exitStatus := severityToExitStatus(alert.Status, alert.Labels["severity"], c.GetConfig().MergedSeverityLevels)
-		if _, ok := alert.Labels["heartbeat"]; ok {
-			// override exitStatus for sending heartbeat
-			exitStatus = 0
+// statusRecorder records the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-		}
-		l.V(2).Infof("Executing ProcessCheckResult on icinga2 for %v: exit status %v",
-			serviceName, exitStatus)
-
-		// Get the Plugin Output from the first Annotation we find that has some data
-		pluginOutput := ""
-		for _, v := range c.GetConfig().AlertManagerConfig.PluginOutputAnnotations {
-
-			// If the PluginOutputByStates option is enabled then first look for an annotation with the state suffix
-			// otherwise fall back to just using the PluginOutputAnnotations value as is
-			if c.GetConfig().AlertManagerConfig.PluginOutputByStates {
-				pluginOutput = alert.Annotations[fmt.Sprintf("%s_%s", v, c.GetConfig().AlertManagerConfig.PluginOutputStateSuffixes[exitStatus])]
-				if pluginOutput != "" {
-					break
-				}
-			}
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
 
-			pluginOutput = alert.Annotations[v]
-			if pluginOutput != "" {
-				break
-			}
+// requestIDHeader carries the ID of a webhook request, which is logged with
+// every message caused by the request
+const requestIDHeader = "X-Request-Id"
+
+// requestID returns the request ID given by the client, or a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// icingaCall runs the Icinga API call operation in a child span of ctx, and
+// returns a logger for its outcome
+func icingaCall(ctx context.Context, l logr.Logger, icinga icinga2.Client, operation string, call func() error) (logr.Logger, error) {
+	endpoint := icinga.GetClientConfig().URL
+	_, span := tracing.StartIcingaCall(ctx, operation, endpoint)
+	start := time.Now()
+	err := call()
+	tracing.End(span, err)
+	return logging.WithCall(l, operation, endpoint, start), err
+}
+
+// recordAudit records a change made in Icinga while handling a webhook
+func recordAudit(ctx context.Context, l logr.Logger, c config.Configuration, event audit.Event) {
+	event.Trigger = audit.TriggerWebhook
+	if err := c.GetAuditLog().Record(ctx, event); err != nil {
+		l.Errorf("Unable to write audit log: %v", err)
+	}
+}
+
+// IsWatchdogAlert returns true if the alert has all the labels given in
+// watchdogLabels. Without watchdog labels, no alert is a watchdog alert.
+func IsWatchdogAlert(alert template.Alert, watchdogLabels map[string]string) bool {
+	if len(watchdogLabels) == 0 {
+		return false
+	}
+	for k, v := range watchdogLabels {
+		if alert.Labels[k] != v {
+			return false
 		}
+	}
+	return true
+}
 
-		err = icinga.ProcessCheckResult(svc, icinga2.Action{
-			ExitStatus:   exitStatus,
-			PluginOutput: pluginOutput,
-		})
+// processAlert updates or creates the Icinga service for a single alert and
+// submits the alert's state as a check result. An error is returned if the
+// alert couldn't be delivered to Icinga.
+func processAlert(ctx context.Context, l logr.Logger, icinga icinga2.Client, serviceHost string, data template.Data, alert template.Alert, c config.Configuration) (result error) {
+	l = l.WithField(logging.FieldFingerprint, alert.Fingerprint)
+	ctx = audit.WithFingerprint(ctx, alert.Fingerprint)
+	ctx, span := tracing.Start(ctx, "alert",
+		tracing.AttrFingerprint.String(alert.Fingerprint),
+		tracing.AttrAlertStatus.String(alert.Status))
+	defer func() { tracing.End(span, result) }()
+
+	l.V(2).Infof("Processing %v alert: alertname=%v, severity=%v, message=%v",
+		alert.Status,
+		alert.Labels["alertname"],
+		alert.Labels["severity"],
+		alert.Annotations["message"])
+
+	// Compute service and display name for alert
+	serviceName, err := computeServiceName(data, alert, c)
+	if err != nil {
+		l.Errorf("Unable to compute internal service name: %v", err)
+		result = err
+	}
+	l = l.WithField(logging.FieldService, serviceName)
+	span.SetAttributes(tracing.AttrService.String(serviceName))
+	var displayName string
+	if c.GetConfig().DisplayNameAsServiceName {
+		displayName = serviceName
+	} else {
+		displayName, err = computeDisplayName(data, alert)
 		if err != nil {
-			l.Errorf("Error in ProcessCheckResult for %v: %v", serviceName, err)
+			l.Errorf("Unable to compute service display name: %v", err)
 		}
 	}
 
-	asJSON(w, http.StatusOK, "success")
+	// Update or create service in icinga
+	svc, err := updateOrCreateService(ctx, l, icinga, serviceHost, serviceName, displayName, alert, c)
+	if err != nil {
+		l.Errorf("Error in updateOrCreateService for %v: %v", serviceName, err)
+		result = err
+	}
+	// If we got an emtpy service object, the service was not
+	// created, don't try to call process-check-result
+	if svc.Name == "" {
+		return result
+	}
+
+	exitStatus := severityToExitStatus(alert.Status, alert.Labels["severity"], c.GetConfig().MergedSeverityLevels)
+	if _, ok := alert.Labels["heartbeat"]; ok {
+		// override exitStatus for sending heartbeat
+		exitStatus = 0
+
+	}
+	l.V(2).Infof("Executing ProcessCheckResult on icinga2 for %v: exit status %v",
+		serviceName, exitStatus)
+
+	now := time.Now()
+	action := createCheckResult(alert, exitStatus, now, c)
+
+	// Heartbeat services rely on receiving every check result, as
+	// each one resets the active check which marks a missed heartbeat
+	_, heartbeat := alert.Labels["heartbeat"]
+	dedup := c.GetConfig().DedupCheckResults && !heartbeat
+	if dedup && resultCache.isDuplicate(svc.FullName(), action, c.GetConfig().DedupRefreshInterval, now) {
+		l.V(2).Infof("Skipping ProcessCheckResult for %v: state and plugin output unchanged", serviceName)
+		return result
+	}
+
+	cl, err := icingaCall(ctx, l, icinga, "process_check_result", func() error {
+		return icinga.ProcessCheckResult(svc, action)
+	})
+	recordAudit(ctx, l, c, audit.Event{
+		Action:       audit.ActionCheckResult,
+		Service:      svc.FullName(),
+		ExitStatus:   &exitStatus,
+		PluginOutput: action.PluginOutput,
+		Error:        audit.ErrorMessage(err),
+	})
+	if err != nil {
+		cl.Errorf("Error in ProcessCheckResult for %v: %v", serviceName, err)
+		return err
+	}
+	cl.V(2).Infof("Submitted check result for %v", serviceName)
+	if dedup {
+		resultCache.record(svc.FullName(), action, now)
+	}
+	return result
 }
@@ -10,11 +10,24 @@
 package webhook
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/alertmanager/template"
 	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
 	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func mockEchoHandler(w http.ResponseWriter, r *http.Request) {
@@ -51,3 +64,153 @@ func TestBearerTokenMissing(t *testing.T) {
 	err := checkBearerToken(req, conf)
 	assert.Error(t, err)
 }
+
+func TestIsWatchdogAlert(t *testing.T) {
+	alert := template.Alert{Labels: map[string]string{"alertname": "Watchdog", "severity": "none"}}
+	assert.False(t, IsWatchdogAlert(alert, nil), "no watchdog labels configured")
+	assert.True(t, IsWatchdogAlert(alert, map[string]string{"alertname": "Watchdog"}))
+	assert.False(t, IsWatchdogAlert(alert, map[string]string{"alertname": "Watchdog", "cluster": "a"}))
+	assert.False(t, IsWatchdogAlert(alert, map[string]string{"alertname": "DeadMansSwitch"}))
+}
+
+// disconnectedClient is a mock Icinga client which can't reach the Icinga API
+type disconnectedClient struct {
+	*icinga2.MockClient
+}
+
+func (c disconnectedClient) Connected() bool {
+	return false
+}
+
+// postWebhook sends body to the webhook handler and returns the response
+func postWebhook(conf config.Configuration, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+	rec := httptest.NewRecorder()
+	Webhook(rec, req, conf)
+	return rec
+}
+
+func TestWebhookWithoutIcinga(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+
+	conf.SetIcingaClient(nil)
+	assert.Equal(t, http.StatusServiceUnavailable, postWebhook(conf, "{}").Code)
+
+	conf.SetIcingaClient(disconnectedClient{icinga2.NewMockClient()})
+	rec := postWebhook(conf, "{}")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	recent := conf.GetStats().RecentWebhooks()
+	if assert.Len(t, recent, 2, "rejected requests are recorded") {
+		assert.Equal(t, http.StatusServiceUnavailable, recent[0].Status)
+		assert.Equal(t, "no Icinga API reachable", recent[0].Error)
+		assert.Equal(t, rec.Header().Get("X-Request-Id"), recent[0].RequestID)
+	}
+}
+
+func TestWebhookRequestID(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	conf.SetIcingaClient(disconnectedClient{icinga2.NewMockClient()})
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook", strings.NewReader("{}"))
+	req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+	req.Header.Set("X-Request-Id", "abc123")
+	rec := httptest.NewRecorder()
+	Webhook(rec, req, conf)
+	assert.Equal(t, "abc123", rec.Header().Get("X-Request-Id"), "the client's request ID is kept")
+
+	first := postWebhook(conf, "{}").Header().Get("X-Request-Id")
+	second := postWebhook(conf, "{}").Header().Get("X-Request-Id")
+	assert.Len(t, first, 16)
+	assert.NotEqual(t, first, second, "a new request ID is generated for each request")
+}
+
+func TestWebhookTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	_, err := tracing.Setup(context.Background(), tracing.Options{})
+	assert.NoError(t, err)
+
+	conf := config.NewMockConfiguration(1)
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+
+	body := `{"version":"4","status":"firing","alerts":[{"status":"firing","fingerprint":"f1","startsAt":"2019-01-01T00:00:00Z","labels":{"alertname":"Traced","severity":"critical"}}]}`
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	Webhook(rec, req, conf)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"webhook", "alert", "updateOrCreateService", "icinga.get_host", "icinga.get_service", "icinga.create_service", "icinga.process_check_result"} {
+		if !assert.Contains(t, spans, name) {
+			return
+		}
+	}
+	webhook := spans["webhook"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", webhook.SpanContext().TraceID().String(), "incoming trace context is propagated")
+	assert.Equal(t, "00f067aa0ba902b7", webhook.Parent().SpanID().String())
+	assert.Equal(t, webhook.SpanContext().SpanID(), spans["alert"].Parent().SpanID())
+	assert.Equal(t, webhook.SpanContext().SpanID(), spans["icinga.get_host"].Parent().SpanID())
+	assert.Equal(t, spans["alert"].SpanContext().SpanID(), spans["icinga.process_check_result"].Parent().SpanID())
+	assert.Equal(t, spans["updateOrCreateService"].SpanContext().SpanID(), spans["icinga.create_service"].Parent().SpanID())
+	assert.Contains(t, spans["alert"].Attributes(), tracing.AttrFingerprint.String("f1"))
+	assert.Contains(t, spans["icinga.process_check_result"].Attributes(), tracing.AttrOperation.String("process_check_result"))
+}
+
+func TestWebhookAudit(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+	var buf bytes.Buffer
+	conf.SetAuditLog(audit.New(&buf, conf.GetConfig().UUID))
+
+	for _, status := range []string{"firing", "resolved"} {
+		body := `{"version":"4","status":"` + status + `","alerts":[{"status":"` + status + `","fingerprint":"f1","startsAt":"2019-01-01T00:00:00Z","labels":{"alertname":"Audited","severity":"critical"}}]}`
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook", strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+		req.Header.Set("X-Request-Id", status)
+		rec := httptest.NewRecorder()
+		Webhook(rec, req, conf)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	var events []audit.Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event audit.Event
+		if !assert.NoError(t, dec.Decode(&event)) {
+			return
+		}
+		events = append(events, event)
+	}
+	if !assert.Len(t, events, 4) {
+		return
+	}
+	actions := []string{audit.ActionServiceCreate, audit.ActionCheckResult, audit.ActionServiceUpdate, audit.ActionCheckResult}
+	requestIDs := []string{"firing", "firing", "resolved", "resolved"}
+	for i, event := range events {
+		assert.Equal(t, actions[i], event.Action)
+		assert.Equal(t, requestIDs[i], event.RequestID)
+		assert.Equal(t, "f1", event.Fingerprint)
+		assert.Equal(t, audit.TriggerWebhook, event.Trigger)
+		assert.Equal(t, conf.GetConfig().UUID, event.Instance)
+		assert.Empty(t, event.Error)
+	}
+	assert.Contains(t, events[0].Changes, "display_name")
+	assert.NotContains(t, events[2].Changes, "display_name", "only changed attributes are recorded")
+	if assert.NotNil(t, events[1].ExitStatus) && assert.NotNil(t, events[3].ExitStatus) {
+		assert.Equal(t, 2, *events[1].ExitStatus)
+		assert.Equal(t, 0, *events[3].ExitStatus)
+	}
+}
@@ -10,6 +10,7 @@
 package webhook
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"regexp"
@@ -17,14 +18,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bketelsen/logr"
 	"github.com/prometheus/alertmanager/template"
 	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/audit"
 	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/tracing"
 )
 
-// validateServiceName checks that computed service name matches constraints
+// ValidateServiceName checks that a service name matches the constraints
 // given by the Icinga configuration
-func validateServiceName(serviceName string) bool {
+func ValidateServiceName(serviceName string) bool {
 	re := regexp.MustCompile(`^[-+_.:,a-zA-Z0-9]{1,128}$`)
 	return re.MatchString(serviceName)
 }
@@ -70,7 +74,7 @@ func computeServiceName(
 	}
 	serviceName = fmt.Sprintf("%v_%v", serviceName, labelhash)
 
-	if validateServiceName(serviceName) {
+	if ValidateServiceName(serviceName) {
 		return serviceName, nil
 	}
 
@@ -101,21 +105,24 @@ func severityToExitStatus(status string, severity string, severityLevels map[str
 	return exitstatus
 }
 
-func createServiceData(hostname string,
+func createServiceData(l logr.Logger,
+	hostname string,
 	serviceName string,
 	displayName string,
 	alert template.Alert,
 	status int,
 	heartbeatInterval time.Duration,
 	c config.Configuration) icinga2.Service {
-	l := c.GetLogger()
 	config := c.GetConfig()
 
 	// build Vars map
 	serviceVars := make(icinga2.Vars)
 	// Set defaults
 	serviceVars["bridge_uuid"] = config.UUID
-	serviceVars["keep_for"] = config.KeepFor
+	serviceVars["keep_for"] = computeKeepFor(alert, c)
+	// Record when the service was last updated, so the garbage collector
+	// can find services whose resolve notification got lost
+	serviceVars["signalilo_last_update"] = float64(time.Now().Unix())
 	serviceVars = mapIcingaVariables(serviceVars, alert.Labels, "label_", l)
 	serviceVars = mapIcingaVariables(serviceVars, alert.Annotations, "annotation_", l)
 	serviceVars = addStaticIcingaVariables(serviceVars, config.StaticServiceVars, l)
@@ -159,17 +166,29 @@ func createServiceData(hostname string,
 	return serviceData
 }
 
+// serviceMapping adjusts the service which is created from an alert to the
+// source of the alert
+type serviceMapping func(alert template.Alert, svc *icinga2.Service)
+
+type serviceMappingKey struct{}
+
+// withServiceMapping returns a context which applies mapService to the
+// services of the alerts delivered with it
+func withServiceMapping(ctx context.Context, mapService serviceMapping) context.Context {
+	return context.WithValue(ctx, serviceMappingKey{}, mapService)
+}
+
 // updateOrCreateService updates or creates an Icinga2 service object from the
 // alert passed to the method
-func updateOrCreateService(icinga icinga2.Client,
+func updateOrCreateService(ctx context.Context,
+	l logr.Logger,
+	icinga icinga2.Client,
 	hostname string,
 	serviceName string,
 	displayName string,
 	alert template.Alert,
 	c config.Configuration) (icinga2.Service, error) {
 
-	l := c.GetLogger()
-
 	// Check if this alert is a heartbeat alert and extract interval if so
 	heartbeatInterval := time.Duration(0)
 	if val, ok := alert.Labels["heartbeat"]; ok {
@@ -186,27 +205,56 @@ func updateOrCreateService(icinga icinga2.Client,
 
 	status := severityToExitStatus(alert.Status, alert.Labels["severity"], c.GetConfig().MergedSeverityLevels)
 
-	serviceData := createServiceData(hostname, serviceName, displayName, alert, status, heartbeatInterval, c)
-	icingaSvc, err := icinga.GetService(serviceData.FullName())
+	serviceData := createServiceData(l, hostname, serviceName, displayName, alert, status, heartbeatInterval, c)
+	if mapService, ok := ctx.Value(serviceMappingKey{}).(serviceMapping); ok {
+		mapService(alert, &serviceData)
+	}
+	ctx, span := tracing.Start(ctx, "updateOrCreateService", tracing.AttrService.String(serviceName))
+	defer span.End()
+	var icingaSvc icinga2.Service
+	_, err := icingaCall(ctx, l, icinga, "get_service", func() (err error) {
+		icingaSvc, err = icinga.GetService(serviceData.FullName())
+		return err
+	})
 	// update or create service, depending on whether object exists
 	if err == nil {
-		l.Infof("updating service: %+v\n", icingaSvc.Name)
+		l.Infof("updating service: %+v", icingaSvc.Name)
 
 		// Templates needs to be ignored if the service is already created due to the Error:
 		// Attribute 'templates' could not be set: Error: Attribute cannot be modified.
 		serviceData.Templates = nil
 
-		err := icinga.UpdateService(serviceData)
+		cl, err := icingaCall(ctx, l, icinga, "update_service", func() error {
+			return icinga.UpdateService(serviceData)
+		})
+		cl.V(2).Infof("UpdateService for %v: err=%v", serviceName, err)
+		recordAudit(ctx, l, c, audit.Event{
+			Action:  audit.ActionServiceUpdate,
+			Service: serviceData.FullName(),
+			Changes: audit.Diff(icingaSvc, serviceData),
+			Error:   audit.ErrorMessage(err),
+		})
 		if err != nil {
 			return serviceData, err
 		}
 	} else if status > 0 {
-		l.Infof("creating service: %+v with templates: %v\n", serviceName, serviceData.Templates)
+		l.Infof("creating service: %+v with templates: %v", serviceName, serviceData.Templates)
 
-		err := icinga.CreateService(serviceData)
+		cl, err := icingaCall(ctx, l, icinga, "create_service", func() error {
+			return icinga.CreateService(serviceData)
+		})
+		cl.V(2).Infof("CreateService for %v: err=%v", serviceName, err)
+		recordAudit(ctx, l, c, audit.Event{
+			Action:  audit.ActionServiceCreate,
+			Service: serviceData.FullName(),
+			Changes: audit.Diff(icinga2.Service{}, serviceData),
+			Error:   audit.ErrorMessage(err),
+		})
 		if err != nil {
 			return serviceData, err
 		}
+		// A freshly created service has no check results yet
+		resultCache.forget(serviceData.FullName())
 	} else {
 		l.Infof("Not creating service %v; status = %v", serviceName, status)
 		return icinga2.Service{}, nil
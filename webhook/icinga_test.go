@@ -10,6 +10,7 @@
 package webhook
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"testing"
@@ -116,7 +117,7 @@ var (
 func TestValidateServiceName(t *testing.T) {
 	for name, tcase := range serviceNames {
 		t.Run(name, func(t *testing.T) {
-			assert.Equal(t, tcase.ok, validateServiceName(tcase.name), "service name validation works correctly")
+			assert.Equal(t, tcase.ok, ValidateServiceName(tcase.name), "service name validation works correctly")
 		})
 	}
 }
@@ -152,7 +153,7 @@ func TestUpdateOrCreateRegularService(t *testing.T) {
 			assert.NoError(t, err)
 			displayName, err := computeDisplayName(template.Data{}, alert)
 			assert.NoError(t, err)
-			svc, err := updateOrCreateService(i, "test.vshn.net", svcName, displayName, alert, c)
+			svc, err := updateOrCreateService(context.Background(), c.GetLogger(), i, "test.vshn.net", svcName, displayName, alert, c)
 			assert.NoError(t, err, fmt.Sprintf("Alert: %+v -> %v; err = %v", alert, svc, err))
 			assert.Equal(t, 1.0, svc.MaxCheckAttempts, "soft states disabled for check %v", displayName)
 			assert.False(t, svc.EnableActiveChecks, "active checks disabled")
@@ -172,7 +173,7 @@ func TestUpdateOrCreateHeartbeatService(t *testing.T) {
 			assert.NoError(t, err)
 			displayName, err := computeDisplayName(template.Data{}, alert)
 			assert.NoError(t, err)
-			svc, err := updateOrCreateService(i, "test.vshn.net", svcName, displayName, alert, c)
+			svc, err := updateOrCreateService(context.Background(), c.GetLogger(), i, "test.vshn.net", svcName, displayName, alert, c)
 			assert.NoError(t, err, "service creation successful")
 			assert.Equal(t, 1.0, svc.MaxCheckAttempts, "soft states disabled")
 			assert.True(t, svc.EnableActiveChecks, "active checks enabled")
@@ -194,9 +195,23 @@ func TestUpdateOrCreateHeartbeatService(t *testing.T) {
 			assert.NoError(t, err)
 			displayName, err := computeDisplayName(template.Data{}, alert)
 			assert.NoError(t, err)
-			svc, err := updateOrCreateService(i, "test.vshn.net", svcName, displayName, alert, c)
+			svc, err := updateOrCreateService(context.Background(), c.GetLogger(), i, "test.vshn.net", svcName, displayName, alert, c)
 			assert.NoError(t, err, "service creation successful")
 			assert.Equal(t, "", svc.Name, "no service object created for resolved heartbeat")
 		})
 	}
 }
+
+func TestCreateServiceDataNotesURL(t *testing.T) {
+	c := config.NewMockConfiguration(1)
+	alert := template.Alert{
+		Labels:      map[string]string{"alertname": "notes"},
+		Annotations: map[string]string{"dashboard_url": "https://grafana/d/dash"},
+	}
+	svc := createServiceData(c.GetLogger(), "test.vshn.net", "notes", "notes", alert, 0, 0, c)
+	assert.Equal(t, "", svc.NotesURL, "dashboard annotations of Alertmanager alerts aren't linked")
+
+	alert.Annotations["runbook_url"] = "https://runbooks/notes"
+	svc = createServiceData(c.GetLogger(), "test.vshn.net", "notes", "notes", alert, 0, 0, c)
+	assert.Equal(t, "https://runbooks/notes", svc.NotesURL)
+}
@@ -0,0 +1,62 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/ingest"
+)
+
+// IngestPath is the path prefix of the generic JSON ingestion endpoint. The
+// name of the source follows the prefix.
+const IngestPath = "/webhook/ingest/"
+
+// IngestWebhook handles incoming JSON events of the source named in the
+// request path, which are mapped to alerts as configured for the source
+func IngestWebhook(w http.ResponseWriter, r *http.Request, c config.Configuration, sources map[string]*ingest.Source) {
+	name := strings.TrimPrefix(r.URL.Path, IngestPath)
+	source, ok := sources[name]
+	if !ok {
+		// Don't reveal which sources are configured to unauthenticated
+		// clients
+		if err := checkBearerToken(r, c); err != nil {
+			asJSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		asJSON(w, http.StatusNotFound, fmt.Sprintf("unknown source %q", name))
+		return
+	}
+	handleWebhook(w, r, c, func(_ context.Context, body io.Reader, _ config.Configuration) (template.Data, error) {
+		return source.Decode(body)
+	})
+}
+
+// CloudEventsWebhook handles incoming CloudEvents, which are mapped to
+// alerts by the configured rules
+func CloudEventsWebhook(w http.ResponseWriter, r *http.Request, c config.Configuration, cfg *ingest.Config) {
+	if len(cfg.CloudEvents) == 0 {
+		if err := checkBearerToken(r, c); err != nil {
+			asJSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		asJSON(w, http.StatusNotFound, "no CloudEvents rules configured")
+		return
+	}
+	handleWebhook(w, r, c, func(_ context.Context, body io.Reader, _ config.Configuration) (template.Data, error) {
+		return cfg.DecodeCloudEvents(r.Header, body)
+	})
+}
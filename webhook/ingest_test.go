@@ -0,0 +1,112 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+	"github.com/vshn/signalilo/ingest"
+)
+
+const ingestConfig = `
+sources:
+  cron:
+    status: 'if .exit_code == 0 then "resolved" else "firing" end'
+    severity: '"warning"'
+    labels:
+      alertname: '"CronJobFailed"'
+      job: .job
+    annotations:
+      message: '"\(.job) exited with \(.exit_code)"'
+`
+
+func TestIngestWebhook(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	conf.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"message"}
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+	cfg, err := ingest.Parse([]byte(ingestConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	token := conf.GetConfig().AlertManagerConfig.BearerToken
+
+	send := func(path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "https://example.com"+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		IngestWebhook(rec, req, conf, cfg.Sources)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send(IngestPath+"unknown", "", "{}").Code, "unknown sources aren't revealed")
+	assert.Equal(t, http.StatusNotFound, send(IngestPath+"unknown", token, "{}").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(IngestPath+"cron", "wrong", "{}").Code)
+	assert.Equal(t, http.StatusBadRequest, send(IngestPath+"cron", token, "{").Code)
+
+	rec := send(IngestPath+"cron", token, `{"job": "backup", "exit_code": 2}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	if !assert.Len(t, icinga.Services, 1) {
+		return
+	}
+	for name, svc := range icinga.Services {
+		assert.Equal(t, "CronJobFailed", svc.Vars["label_alertname"])
+		assert.Equal(t, "backup", svc.Vars["label_job"])
+		actions := icinga.Actions[name]
+		if assert.Len(t, actions, 1) {
+			assert.Equal(t, 1, actions[0].ExitStatus)
+			assert.Equal(t, "backup exited with 2", actions[0].PluginOutput)
+		}
+	}
+}
+
+func TestCloudEventsWebhook(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	conf.GetConfig().AlertManagerConfig.PluginOutputAnnotations = []string{"message"}
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+	cfg, err := ingest.Parse([]byte("cloudevents:\n  - status: .data.healthy | not\n    annotations:\n      message: .data.message\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	event := `{"specversion": "1.0", "id": "1", "type": "health", "source": "/billing", "data": {"healthy": false, "message": "down"}}`
+
+	send := func(cfg *ingest.Config) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/webhook/cloudevents", strings.NewReader(event))
+		req.Header.Add("Authorization", "Bearer "+conf.GetConfig().AlertManagerConfig.BearerToken)
+		req.Header.Add("Content-Type", "application/cloudevents+json")
+		rec := httptest.NewRecorder()
+		CloudEventsWebhook(rec, req, conf, cfg)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, send(&ingest.Config{}).Code)
+	assert.Equal(t, http.StatusOK, send(cfg).Code)
+	if !assert.Len(t, icinga.Services, 1) {
+		return
+	}
+	for name, svc := range icinga.Services {
+		assert.Equal(t, "health", svc.Vars["label_alertname"])
+		assert.Equal(t, "/billing", svc.Vars["label_source"])
+		if actions := icinga.Actions[name]; assert.Len(t, actions, 1) {
+			assert.Equal(t, "down", actions[0].PluginOutput)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bketelsen/logr"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+const perfDataKeyPrefix = "icinga_perfdata_"
+
+var (
+	// perfDataValuePattern splits a value such as `12.5ms` into the number
+	// and the unit of measurement
+	perfDataValuePattern = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
+	// perfDataRangePattern matches Nagios plugin threshold ranges, e.g.
+	// `10`, `10:`, `~:10`, `10:20` or `@10:20`
+	perfDataRangePattern = regexp.MustCompile(`^@?(~|[-+]?[0-9]*\.?[0-9]+)?(:([-+]?[0-9]*\.?[0-9]+)?)?$`)
+	// perfDataUnits lists the units of measurement which Icinga accepts
+	perfDataUnits = map[string]bool{
+		"": true, "s": true, "ms": true, "us": true, "%": true, "c": true,
+		"B": true, "KB": true, "MB": true, "GB": true, "TB": true,
+	}
+)
+
+// formatPerfDataLabel quotes a perfdata label if it contains characters
+// which aren't allowed in an unquoted label
+func formatPerfDataLabel(label string) string {
+	if strings.ContainsAny(label, " ='") {
+		return fmt.Sprintf("'%v'", strings.ReplaceAll(label, "'", "''"))
+	}
+	return label
+}
+
+// parsePerfData converts a label and a value of the form
+// `value[UOM][;warn[;crit[;min[;max]]]]` into an Icinga performance data
+// entry
+func parsePerfData(label string, value string) (string, error) {
+	fields := strings.Split(strings.TrimSpace(value), ";")
+	if len(fields) > 5 {
+		return "", fmt.Errorf("too many fields in '%v'", value)
+	}
+
+	matches := perfDataValuePattern.FindStringSubmatch(strings.TrimSpace(fields[0]))
+	if matches == nil {
+		return "", fmt.Errorf("value '%v' is not a number", fields[0])
+	}
+	if !perfDataUnits[matches[2]] {
+		return "", fmt.Errorf("unknown unit of measurement '%v'", matches[2])
+	}
+
+	for i, f := range fields[1:] {
+		f = strings.TrimSpace(f)
+		fields[i+1] = f
+		if f == "" {
+			continue
+		}
+		if i < 2 {
+			// warn and crit are threshold ranges
+			if !perfDataRangePattern.MatchString(f) {
+				return "", fmt.Errorf("invalid threshold '%v'", f)
+			}
+		} else if _, err := strconv.ParseFloat(f, 64); err != nil {
+			return "", fmt.Errorf("invalid min/max '%v'", f)
+		}
+	}
+	fields[0] = matches[1] + matches[2]
+
+	// Drop trailing empty fields
+	for len(fields) > 1 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+
+	return fmt.Sprintf("%v=%v", formatPerfDataLabel(label), strings.Join(fields, ";")), nil
+}
+
+// collectPerfDataSources adds all entries of kv which should be rendered as
+// performance data to sources. Keys starting with `icinga_perfdata_` are
+// always used, with the prefix stripped. Additionally, the keys listed in
+// names are used as is.
+func collectPerfDataSources(sources map[string]string, kv map[string]string, names []string) {
+	for k, v := range kv {
+		if strings.HasPrefix(k, perfDataKeyPrefix) && len(k) > len(perfDataKeyPrefix) {
+			sources[strings.TrimPrefix(k, perfDataKeyPrefix)] = v
+		}
+	}
+	for _, name := range names {
+		if v, ok := kv[name]; ok {
+			sources[name] = v
+		}
+	}
+}
+
+// computePerfData renders the alert's labels and annotations which are
+// configured as performance data sources into Icinga performance data.
+// Annotations take precedence over labels with the same name.
+func computePerfData(alert template.Alert, c config.Configuration) icinga2.PerfData {
+	l := c.GetLogger()
+	amConfig := c.GetConfig().AlertManagerConfig
+
+	// Resolved alerts carry the values of the last evaluation while the
+	// alert was firing, which would be misleading in graphs
+	if alert.Status == "resolved" {
+		return nil
+	}
+
+	sources := make(map[string]string)
+	collectPerfDataSources(sources, alert.Labels, amConfig.PerfDataLabels)
+	collectPerfDataSources(sources, alert.Annotations, amConfig.PerfDataAnnotations)
+
+	return renderPerfData(sources, l)
+}
+
+// renderPerfData converts the given perfdata labels and values into sorted
+// Icinga performance data, skipping values that can't be parsed
+func renderPerfData(sources map[string]string, l logr.Logger) icinga2.PerfData {
+	var labels []string
+	for k := range sources {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+
+	var perfData icinga2.PerfData
+	for _, label := range labels {
+		entry, err := parsePerfData(label, sources[label])
+		if err != nil {
+			l.Infof("Not adding performance data '%v': %v", label, err)
+			continue
+		}
+		perfData = append(perfData, entry)
+	}
+	return perfData
+}
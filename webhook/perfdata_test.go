@@ -0,0 +1,79 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"testing"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+var parsePerfDataTest = map[string]struct {
+	label  string
+	value  string
+	output string
+	ok     bool
+}{
+	"plain value":       {"value", "0.937", "value=0.937", true},
+	"value with unit":   {"latency", "12.5ms", "latency=12.5ms", true},
+	"full format":       {"disk", "7%;20:;10:;0;100", "disk=7%;20:;10:;0;100", true},
+	"empty thresholds":  {"disk", "7%;;;0;100", "disk=7%;;;0;100", true},
+	"trailing fields":   {"disk", "7%;80;;;", "disk=7%;80", true},
+	"inverted range":    {"temp", "42;@10:20;~:50", "temp=42;@10:20;~:50", true},
+	"exponent":          {"rate", "1.5e-3", "rate=1.5e-3", true},
+	"quoted label":      {"free space", "10GB", "'free space'=10GB", true},
+	"not a number":      {"value", "NaN", "", false},
+	"unknown unit":      {"value", "10parsecs", "", false},
+	"invalid threshold": {"value", "10;abc", "", false},
+	"invalid max":       {"value", "10;;;0;lots", "", false},
+	"too many fields":   {"value", "1;2;3;4;5;6", "", false},
+}
+
+func TestParsePerfData(t *testing.T) {
+	for name, test := range parsePerfDataTest {
+		t.Run(name, func(t *testing.T) {
+			output, err := parsePerfData(test.label, test.value)
+			assert.Equal(t, test.ok, err == nil, "parsing result: %v", err)
+			assert.Equal(t, test.output, output)
+		})
+	}
+}
+
+func TestComputePerfData(t *testing.T) {
+	c := config.NewMockConfiguration(1)
+	c.GetConfig().AlertManagerConfig.PerfDataAnnotations = []string{"value"}
+	c.GetConfig().AlertManagerConfig.PerfDataLabels = []string{"instance_count"}
+
+	alert := template.Alert{
+		Status: "firing",
+		Labels: map[string]string{
+			"alertname":             "test",
+			"instance_count":        "3",
+			"icinga_perfdata_usage": "10%",
+		},
+		Annotations: map[string]string{
+			"value":                 "0.5",
+			"icinga_perfdata_usage": "20%;80;90",
+			"icinga_perfdata_bad":   "lots",
+			"message":               "not perfdata",
+		},
+	}
+	assert.Equal(t, icinga2.PerfData{
+		"instance_count=3",
+		"usage=20%;80;90",
+		"value=0.5",
+	}, computePerfData(alert, c))
+
+	alert.Status = "resolved"
+	assert.Empty(t, computePerfData(alert, c), "no perfdata for resolved alerts")
+}
@@ -0,0 +1,49 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/vshn/signalilo/config"
+)
+
+// keepForKey is the annotation or label with which an alert sets its own
+// keep_for
+const keepForKey = "signalilo_keep_for"
+
+// computeKeepFor computes how long the service for alert is kept after it
+// has transitioned to OK. The keep_for set by the alert's annotations or
+// labels takes precedence over the first matching keep_for policy, which in
+// turn takes precedence over the global keep_for.
+func computeKeepFor(alert template.Alert, c config.Configuration) time.Duration {
+	l := c.GetLogger()
+	cfg := c.GetConfig()
+
+	for _, kv := range []template.KV{alert.Annotations, alert.Labels} {
+		val, ok := kv[keepForKey]
+		if !ok {
+			continue
+		}
+		keepFor, err := time.ParseDuration(val)
+		if err == nil && keepFor >= 0 {
+			return keepFor
+		}
+		l.Errorf("Ignoring invalid %v %q of alert %v", keepForKey, val, alert.Labels["alertname"])
+	}
+
+	for _, policy := range cfg.KeepForPolicies {
+		if val, ok := alert.Labels[policy.Label]; ok && val == policy.Value {
+			return policy.KeepFor
+		}
+	}
+	return cfg.KeepFor
+}
@@ -0,0 +1,75 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/signalilo/config"
+)
+
+var computeKeepForTest = map[string]struct {
+	labels      template.KV
+	annotations template.KV
+	keepFor     time.Duration
+}{
+	"global keep_for": {
+		template.KV{"severity": "warning"},
+		template.KV{},
+		5 * time.Minute,
+	},
+	"policy": {
+		template.KV{"severity": "critical"},
+		template.KV{},
+		720 * time.Hour,
+	},
+	"first matching policy": {
+		template.KV{"severity": "critical", "team": "infra"},
+		template.KV{},
+		24 * time.Hour,
+	},
+	"label": {
+		template.KV{"severity": "critical", keepForKey: "1h"},
+		template.KV{},
+		time.Hour,
+	},
+	"annotation overrides label": {
+		template.KV{keepForKey: "1h"},
+		template.KV{keepForKey: "2h"},
+		2 * time.Hour,
+	},
+	"invalid annotation": {
+		template.KV{"severity": "critical"},
+		template.KV{keepForKey: "forever"},
+		720 * time.Hour,
+	},
+	"negative label": {
+		template.KV{keepForKey: "-1h"},
+		template.KV{},
+		5 * time.Minute,
+	},
+}
+
+func TestComputeKeepFor(t *testing.T) {
+	c := config.NewMockConfiguration(0)
+	c.GetConfig().KeepForPolicies = []config.KeepForPolicy{
+		{Label: "team", Value: "infra", KeepFor: 24 * time.Hour},
+		{Label: "severity", Value: "critical", KeepFor: 720 * time.Hour},
+	}
+	for name, tc := range computeKeepForTest {
+		t.Run(name, func(t *testing.T) {
+			alert := template.Alert{Labels: tc.labels, Annotations: tc.annotations}
+			assert.Equal(t, tc.keepFor, computeKeepFor(alert, c))
+		})
+	}
+}
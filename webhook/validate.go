@@ -0,0 +1,105 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+)
+
+// alertmanagerVersion is the version of the Alertmanager webhook payload
+// which Signalilo understands
+const alertmanagerVersion = "4"
+
+// maxClockSkew is how far in the future alerts may start, to allow for
+// clock differences between Alertmanager and Signalilo
+const maxClockSkew = 10 * time.Minute
+
+// fieldError is a validation error of a single field of a webhook payload
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// validationError holds all validation errors of a webhook payload
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, f := range e {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", f.Field, f.Message))
+	}
+	return "invalid payload: " + strings.Join(msgs, "; ")
+}
+
+// validateAlertmanager checks that data is a well-formed Alertmanager
+// webhook payload of the given version
+func validateAlertmanager(version string, data template.Data, now time.Time) error {
+	errs := validationError{}
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch version {
+	case alertmanagerVersion:
+	case "":
+		add("version", "is required")
+	default:
+		add("version", "unsupported version %q, expected %q", version, alertmanagerVersion)
+	}
+	if !validStatus(data.Status) {
+		add("status", "must be firing or resolved, got %q", data.Status)
+	}
+	if len(data.Alerts) == 0 {
+		add("alerts", "must contain at least one alert")
+	}
+	for i, alert := range data.Alerts {
+		field := fmt.Sprintf("alerts[%d]", i)
+		if !validStatus(alert.Status) {
+			add(field+".status", "must be firing or resolved, got %q", alert.Status)
+		}
+		if alert.Labels["alertname"] == "" {
+			add(field+".labels.alertname", "is required")
+		}
+		switch {
+		case alert.StartsAt.IsZero():
+			add(field+".startsAt", "is required")
+		case alert.StartsAt.After(now.Add(maxClockSkew)):
+			add(field+".startsAt", "%v is in the future", alert.StartsAt.Format(time.RFC3339))
+		}
+		if !alert.EndsAt.IsZero() && alert.EndsAt.Before(alert.StartsAt) {
+			add(field+".endsAt", "%v is before startsAt", alert.EndsAt.Format(time.RFC3339))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateAlertCount checks that data has no more than max alerts. 0 allows
+// any number of alerts.
+func validateAlertCount(data template.Data, max int) error {
+	if max > 0 && len(data.Alerts) > max {
+		return validationError{{
+			Field:   "alerts",
+			Message: fmt.Sprintf("%d alerts exceed the maximum of %d", len(data.Alerts), max),
+		}}
+	}
+	return nil
+}
+
+func validStatus(status string) bool {
+	return status == string(model.AlertFiring) || status == string(model.AlertResolved)
+}
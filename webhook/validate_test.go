@@ -0,0 +1,88 @@
+/*
+ * Authors:
+ * Simon Gerber <simon.gerber@vshn.ch>
+ *
+ * License:
+ * Copyright (c) 2019, VSHN AG, <info@vshn.ch>
+ * Licensed under "BSD 3-Clause". See LICENSE file.
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/vshn/go-icinga2-client/icinga2"
+	"github.com/vshn/signalilo/config"
+)
+
+func TestValidateAlertmanager(t *testing.T) {
+	now := time.Now()
+	valid := template.Alert{Status: "firing", Labels: template.KV{"alertname": "Test"}, StartsAt: now.Add(-time.Hour)}
+	assert.NoError(t, validateAlertmanager("4", template.Data{Status: "firing", Alerts: template.Alerts{valid}}, now))
+
+	err := validateAlertmanager("", template.Data{}, now)
+	assert.Equal(t, validationError{
+		{Field: "version", Message: "is required"},
+		{Field: "status", Message: `must be firing or resolved, got ""`},
+		{Field: "alerts", Message: "must contain at least one alert"},
+	}, err)
+
+	invalid := template.Data{Status: "resolved", Alerts: template.Alerts{
+		valid,
+		{Status: "pending", Labels: template.KV{}, StartsAt: now.Add(time.Hour)},
+		{Status: "resolved", Labels: template.KV{"alertname": "Test"}, StartsAt: now, EndsAt: now.Add(-time.Minute)},
+		{Status: "firing", Labels: template.KV{"alertname": "Test"}},
+	}}
+	err = validateAlertmanager("3", invalid, now)
+	if verr, ok := err.(validationError); assert.True(t, ok) {
+		fields := []string{}
+		for _, f := range verr {
+			fields = append(fields, f.Field)
+		}
+		assert.Equal(t, []string{
+			"version",
+			"alerts[1].status",
+			"alerts[1].labels.alertname",
+			"alerts[1].startsAt",
+			"alerts[2].endsAt",
+			"alerts[3].startsAt",
+		}, fields)
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	conf := config.NewMockConfiguration(1)
+	icinga := icinga2.NewMockClient()
+	_ = icinga.CreateHost(icinga2.Host{Name: conf.GetConfig().HostName})
+	conf.SetIcingaClient(icinga)
+
+	rec := postWebhook(conf, "{}")
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "empty payloads are rejected")
+	response := responseJSON{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "invalid payload", response.Message)
+	assert.Contains(t, response.Errors, fieldError{Field: "version", Message: "is required"})
+	assert.Empty(t, icinga.Services)
+
+	alert := `{"status":"firing","startsAt":"2019-01-01T00:00:00Z","labels":{"alertname":"Test"}}`
+	body := `{"version":"4","status":"firing","alerts":[` + alert + `,` + alert + `]}`
+	conf.GetConfig().AlertManagerConfig.MaxAlerts = 1
+	rec = postWebhook(conf, body)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "2 alerts exceed the maximum of 1")
+
+	conf.GetConfig().AlertManagerConfig.MaxAlerts = 0
+	conf.GetConfig().AlertManagerConfig.MaxBodySize = int64(len(body) - 1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postWebhook(conf, body).Code)
+
+	conf.GetConfig().AlertManagerConfig.MaxBodySize = int64(len(body))
+	assert.Equal(t, http.StatusOK, postWebhook(conf, body).Code)
+	assert.True(t, strings.HasPrefix(conf.GetStats().RecentWebhooks()[1].Error, "request body too large"))
+}
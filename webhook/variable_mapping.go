@@ -55,6 +55,11 @@ func mapIcingaVariable(key, value string) (string, interface{}, error) {
 
 	case "string":
 		return k, value, nil
+
+	case "perfdata":
+		// Rendered into the check result's performance data instead of a
+		// custom variable
+		return key, value, ErrorNotAMappingKey
 	}
 
 	return "", nil, ErrorUnknownMappingType
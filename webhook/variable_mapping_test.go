@@ -21,6 +21,7 @@ var mapIcingaVariableTest = map[string]struct {
 	"mapped number": {"icinga_number_foo", "42", "foo", 42, nil},
 	"mapped string": {"icinga_string_foo", "bar", "foo", "bar", nil},
 	"unknown":       {"icinga_unknown_foo", "bar", "", nil, ErrorUnknownMappingType},
+	"perfdata":      {"icinga_perfdata_foo", "42", "icinga_perfdata_foo", "42", ErrorNotAMappingKey},
 }
 
 func TestMapIcingaVariable(t *testing.T) {